@@ -0,0 +1,100 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v3"
+
+	"github.com/corazawaf/coraza-spoa/internal"
+)
+
+// adminServer serves the metrics, the health probes and optionally the
+// admin API.
+type adminServer struct {
+	// reload asks the main loop to reload the configuration.
+	reload func(ctx context.Context) (reloadSummary, error)
+
+	agent  atomic.Pointer[internal.Agent]
+	config atomic.Pointer[config]
+	ready  atomic.Bool
+}
+
+func (s *adminServer) handler(adminAPI bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	if adminAPI {
+		mux.HandleFunc("GET /apps", s.handleApps)
+		mux.HandleFunc("GET /config", s.handleConfig)
+		mux.HandleFunc("POST /reload", s.handleReload)
+	}
+	return mux
+}
+
+// setReady marks the agent as ready once all applications are compiled and
+// the listeners are open.
+func (s *adminServer) setReady(a *internal.Agent, cfg *config) {
+	s.agent.Store(a)
+	s.config.Store(cfg)
+	s.ready.Store(true)
+}
+
+func (s *adminServer) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *adminServer) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	if !s.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *adminServer) handleApps(w http.ResponseWriter, _ *http.Request) {
+	a := s.agent.Load()
+	if a == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(a.Status())
+}
+
+func (s *adminServer) handleConfig(w http.ResponseWriter, _ *http.Request) {
+	cfg := s.config.Load()
+	if cfg == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	redacted, err := cfg.redacted()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := yaml.Marshal(redacted)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(out)
+}
+
+func (s *adminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	summary, err := s.reload(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summary)
+}
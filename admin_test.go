@@ -0,0 +1,202 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+
+	"github.com/corazawaf/coraza-spoa/internal"
+)
+
+func serveAdmin(t *testing.T, h http.Handler, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func TestAdminServer_Probes(t *testing.T) {
+	s := &adminServer{}
+	h := s.handler(false)
+
+	if rec := serveAdmin(t, h, http.MethodGet, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("expected /healthz to be ok while starting, got %d", rec.Code)
+	}
+	if rec := serveAdmin(t, h, http.MethodGet, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to be unavailable while starting, got %d", rec.Code)
+	}
+
+	s.setReady(&internal.Agent{Logger: zerolog.Nop()}, &config{})
+	if rec := serveAdmin(t, h, http.MethodGet, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("expected /healthz to be ok, got %d", rec.Code)
+	}
+	if rec := serveAdmin(t, h, http.MethodGet, "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("expected /readyz to be ok when ready, got %d", rec.Code)
+	}
+
+	// shutting down
+	s.ready.Store(false)
+	if rec := serveAdmin(t, h, http.MethodGet, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to be unavailable on shutdown, got %d", rec.Code)
+	}
+}
+
+func TestAdminServer_AdminAPIDisabled(t *testing.T) {
+	s := &adminServer{}
+	s.setReady(&internal.Agent{Logger: zerolog.Nop()}, &config{})
+	h := s.handler(false)
+
+	for _, target := range []string{"/apps", "/config"} {
+		if rec := serveAdmin(t, h, http.MethodGet, target); rec.Code != http.StatusNotFound {
+			t.Errorf("expected %s not to be served, got %d", target, rec.Code)
+		}
+	}
+	if rec := serveAdmin(t, h, http.MethodPost, "/reload"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected /reload not to be served, got %d", rec.Code)
+	}
+}
+
+func TestAdminServer_Apps(t *testing.T) {
+	app, err := internal.AppConfig{
+		Name:   "default",
+		Logger: zerolog.Nop(),
+	}.NewApplication()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Close)
+
+	s := &adminServer{}
+	h := s.handler(true)
+	if rec := serveAdmin(t, h, http.MethodGet, "/apps"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /apps to be unavailable while starting, got %d", rec.Code)
+	}
+
+	s.setReady(&internal.Agent{
+		Applications:       map[string]*internal.Application{"default": app},
+		DefaultApplication: app,
+		Logger:             zerolog.Nop(),
+	}, &config{})
+	rec := serveAdmin(t, h, http.MethodGet, "/apps")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected /apps to be ok, got %d", rec.Code)
+	}
+	var status internal.Status
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Applications) != 1 || status.Applications[0].Name != "default" || !status.Applications[0].Default {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestAdminServer_Config(t *testing.T) {
+	var cfg config
+	err := yaml.Unmarshal([]byte(`
+bind: 127.0.0.1:9000
+templates:
+  - name: base
+    directives: SecRuleEngine On
+applications:
+  - name: default
+    directives: SecRuleEngine On
+    log_file: /var/log/s3cr3t-token.log
+`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.secrets = []string{"s3cr3t-token"}
+
+	s := &adminServer{}
+	h := s.handler(true)
+	if rec := serveAdmin(t, h, http.MethodGet, "/config"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /config to be unavailable while starting, got %d", rec.Code)
+	}
+
+	s.setReady(&internal.Agent{Logger: zerolog.Nop()}, &cfg)
+	rec := serveAdmin(t, h, http.MethodGet, "/config")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected /config to be ok, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, leaked := range []string{"SecRuleEngine", "s3cr3t-token"} {
+		if strings.Contains(body, leaked) {
+			t.Errorf("expected %q to be redacted:\n%s", leaked, body)
+		}
+	}
+
+	var served config
+	if err := yaml.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if got := served.Applications[0].Directives; got != "[redacted]" {
+		t.Errorf("expected redacted directives, got %q", got)
+	}
+	if got := served.Applications[0].Log.File; got != "[redacted]" {
+		t.Errorf("expected redacted log_file, got %q", got)
+	}
+	if got := served.Bind; len(got) != 1 || got[0] != "127.0.0.1:9000" {
+		t.Errorf("expected bind to be served, got %v", got)
+	}
+	if cfg.Applications[0].Directives != "SecRuleEngine On" {
+		t.Error("expected the loaded config not to be modified")
+	}
+}
+
+func TestAdminServer_Reload(t *testing.T) {
+	tests := []struct {
+		name     string
+		summary  reloadSummary
+		err      error
+		wantCode int
+		wantBody string
+	}{
+		{
+			name: "success",
+			summary: reloadSummary{
+				Reloaded:  []string{"b"},
+				Unchanged: []string{"a"},
+				Removed:   []string{},
+			},
+			wantCode: http.StatusOK,
+			wantBody: `{"reloaded":["b"],"unchanged":["a"],"removed":[]}`,
+		},
+		{
+			name:     "error",
+			err:      errors.New("error loading configuration: invalid bind_mode"),
+			wantCode: http.StatusInternalServerError,
+			wantBody: "error loading configuration: invalid bind_mode",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &adminServer{reload: func(context.Context) (reloadSummary, error) {
+				return tt.summary, tt.err
+			}}
+			h := s.handler(true)
+
+			if rec := serveAdmin(t, h, http.MethodGet, "/reload"); rec.Code != http.StatusMethodNotAllowed {
+				t.Errorf("expected GET /reload not to be allowed, got %d", rec.Code)
+			}
+			rec := serveAdmin(t, h, http.MethodPost, "/reload")
+			if rec.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d", tt.wantCode, rec.Code)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+				t.Errorf("expected body %q, got %q", tt.wantBody, got)
+			}
+		})
+	}
+}
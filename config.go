@@ -1,11 +1,18 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"net/url"
 	"os"
+	"os/user"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -16,92 +23,433 @@ import (
 )
 
 func readConfig() (*config, error) {
-	open, err := os.Open(configPath)
+	var in interpolator
+	var cfg config
+	root, err := decodeConfigFile(configPath, &in, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	defer open.Close()
-
-	d := yaml.NewDecoder(open)
-	d.KnownFields(true)
-
-	var cfg config
-	if err := d.Decode(&cfg); err != nil {
+	cfg.positions.readPositions(configPath, root)
+	if err := cfg.includeApplications(&in); err != nil {
 		return nil, err
 	}
+	cfg.secrets = in.secrets
 
 	if len(cfg.Applications) == 0 {
 		globalLogger.Warn().Msg("no applications defined")
 	}
 
 	if cfg.DefaultApplication != "" {
-		var found bool
-		for _, app := range cfg.Applications {
-			if app.Name == cfg.DefaultApplication {
-				globalLogger.Debug().Str("app", cfg.DefaultApplication).Msg("configured as default application")
-				found = true
-				break
+		if !cfg.hasApplication(cfg.DefaultApplication) {
+			return nil, fmt.Errorf("default application not found among defined applications: %s", cfg.DefaultApplication)
+		}
+		globalLogger.Debug().Str("app", cfg.DefaultApplication).Msg("configured as default application")
+	}
+
+	if cfg.perm, err = cfg.socketPermissions(); err != nil {
+		return nil, err
+	}
+
+	if cfg.onErrorAction, err = internal.ParseFailAction(cfg.OnError); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateTemplates(); err != nil {
+		return nil, err
+	}
+	for i, app := range cfg.Applications {
+		settings, err := cfg.parseApplication(i)
+		if err != nil {
+			return nil, fmt.Errorf("application %q: %v", app.Name, err)
+		}
+		cfg.Applications[i].settings = settings
+	}
+
+	for i, r := range cfg.Routes {
+		if r.Host == "" && r.HostRegex == "" && r.Port == 0 {
+			return nil, fmt.Errorf("route %d: one of host, host_regex or port is required", i)
+		}
+		if r.Host != "" && r.HostRegex != "" {
+			return nil, fmt.Errorf("route %d: host and host_regex are mutually exclusive", i)
+		}
+		route := internal.Route{
+			Host:        r.Host,
+			Port:        r.Port,
+			Application: r.Application,
+		}
+		if r.HostRegex != "" {
+			if route.HostRegex, err = regexp.Compile(r.HostRegex); err != nil {
+				return nil, fmt.Errorf("route %d: invalid host_regex: %v", i, err)
 			}
 		}
-		if !found {
-			return nil, fmt.Errorf("default application not found among defined applications: %s", cfg.DefaultApplication)
+		if !cfg.hasApplication(r.Application) {
+			return nil, fmt.Errorf("route %d: application not found among defined applications: %s", i, r.Application)
 		}
+		cfg.routes = append(cfg.routes, route)
+	}
+
+	if err := cfg.checkSemantics(); err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
 }
 
+// decodeConfigFile decodes a config file into out, after interpolating its
+// values. It returns the root node of the file.
+func decodeConfigFile(path string, in *interpolator, out *config) (*yaml.Node, error) {
+	open, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer open.Close()
+
+	var root yaml.Node
+	if err := yaml.NewDecoder(open).Decode(&root); err != nil {
+		return nil, err
+	}
+	if err := in.expandNode(&root); err != nil {
+		return nil, fmt.Errorf("interpolating config: %v", err)
+	}
+
+	// The expanded node is decoded directly to keep the lines of the file
+	// in errors. Node.Decode does not support KnownFields, so unknown keys
+	// are checked separately.
+	if err := root.Decode(out); err != nil {
+		return nil, err
+	}
+	if err := checkKnownFields(&root, reflect.TypeOf(out), "config"); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// checkKnownFields reports keys of the node which are not a yaml key of
+// the matching struct type. name is the key of the node in errors.
+func checkKnownFields(node *yaml.Node, t reflect.Type, name string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return checkKnownFields(node.Content[0], t, name)
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Value == "<<" {
+				// merge key
+				continue
+			}
+			f, ok := fields[key.Value]
+			if !ok {
+				return fmt.Errorf("line %d: field %s not found in %s", key.Line, key.Value, name)
+			}
+			if err := checkKnownFields(node.Content[i+1], f, key.Value); err != nil {
+				return err
+			}
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := checkKnownFields(item, t.Elem(), name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type config struct {
-	Bind               string    `yaml:"bind"`
+	Bind bindList `yaml:"bind"`
+	// BindMode, BindOwner and BindGroup are applied to unix sockets.
+	BindMode           string    `yaml:"bind_mode"`
+	BindOwner          string    `yaml:"bind_owner"`
+	BindGroup          string    `yaml:"bind_group"`
 	Log                logConfig `yaml:",inline"`
 	DefaultApplication string    `yaml:"default_application"`
-	Applications       []struct {
+	OnError            string    `yaml:"on_error"`
+	// ShutdownGracePeriodMS is the time to wait for in-flight messages on shutdown.
+	ShutdownGracePeriodMS int `yaml:"shutdown_grace_period_ms"`
+	Applications          []struct {
 		Log              logConfig `yaml:",inline"`
 		Name             string    `yaml:"name"`
 		Directives       string    `yaml:"directives"`
 		ResponseCheck    bool      `yaml:"response_check"`
 		TransactionTTLMS int       `yaml:"transaction_ttl_ms"`
+		OnError          string    `yaml:"on_error"`
+		// IDGenerator creates ids for requests without an id argument.
+		IDGenerator idGeneratorConfig `yaml:"id_generator"`
+		// IDMaxLength limits the length of ids sent by HAProxy.
+		IDMaxLength int `yaml:"id_max_length"`
+		// TruncatedBody is the policy for bodies shorter than announced.
+		TruncatedBody string `yaml:"truncated_body"`
+		// InterruptionFields are exported to HAProxy on an interruption.
+		InterruptionFields []string `yaml:"interruption_fields"`
+		// AttackRules selects the rules counted in rules_hit.
+		AttackRules attackRulesConfig `yaml:"attack_rules"`
+		// DirectivesFiles are paths or globs and DirectivesDir is a directory
+		// of *.conf files, relative to the config file. They are loaded
+		// after Directives.
+		DirectivesFiles []string `yaml:"directives_files"`
+		DirectivesDir   string   `yaml:"directives_dir"`
+		// Extends names the template providing the directives. The
+		// PrependDirectives and AppendDirectives are loaded before and
+		// after them.
+		Extends           string `yaml:"extends"`
+		PrependDirectives string `yaml:"prepend_directives"`
+		AppendDirectives  string `yaml:"append_directives"`
+
+		// settings are parsed while reading the config.
+		settings appSettings
 	} `yaml:"applications"`
+	// Templates are shared directives which applications can extend.
+	Templates []templateConfig `yaml:"templates"`
+	// IncludeDir is a directory of YAML files defining further
+	// applications, relative to the config file.
+	IncludeDir string `yaml:"include_dir"`
+	Routes     []struct {
+		Host        string `yaml:"host"`
+		HostRegex   string `yaml:"host_regex"`
+		Port        int64  `yaml:"port"`
+		Application string `yaml:"application"`
+	} `yaml:"routes"`
+
+	// secrets are the values interpolated from files.
+	secrets []string
+	// positions locate the settings for error messages.
+	positions configPositions
+	// onErrorAction, perm and routes are parsed while reading the config.
+	onErrorAction internal.FailAction
+	perm          socketPermissions
+	routes        []internal.Route
 }
 
-func (c config) networkAddressFromBind() (network string, address string) {
-	bindUrl, err := url.Parse(c.Bind)
-	if err == nil {
-		return bindUrl.Scheme, bindUrl.Path
+// appSettings are the settings of an application parsed while reading the
+// config.
+type appSettings struct {
+	// onError defaults to the global on_error.
+	onError            internal.FailAction
+	idGenerator        internal.IDGenerator
+	truncatedBody      internal.TruncatedBodyPolicy
+	interruptionFields []internal.InterruptionField
+	attackRules        internal.AttackRules
+	// directives include those of the extended template and the prepended
+	// and appended directives.
+	directives string
+	// directivesFiles are resolved in load order.
+	directivesFiles []string
+}
+
+// parseApplication parses the settings of the i-th application.
+func (c config) parseApplication(i int) (appSettings, error) {
+	a := c.Applications[i]
+	if a.Extends != "" && a.Directives != "" {
+		return appSettings{}, fmt.Errorf("directives and extends are mutually exclusive, use prepend_directives or append_directives")
+	}
+	if a.IDMaxLength < 0 {
+		return appSettings{}, fmt.Errorf("id_max_length must not be negative")
 	}
 
-	return "tcp", c.Bind
+	s := appSettings{onError: c.onErrorAction}
+	var err error
+	directives := a.Directives
+	if a.Extends != "" {
+		if directives, err = c.templateDirectives(a.Extends); err != nil {
+			return appSettings{}, err
+		}
+	}
+	s.directives = joinDirectives(a.PrependDirectives, directives, a.AppendDirectives)
+	if a.OnError != "" {
+		if s.onError, err = internal.ParseFailAction(a.OnError); err != nil {
+			return appSettings{}, err
+		}
+	}
+	if s.idGenerator, err = a.IDGenerator.newIDGenerator(); err != nil {
+		return appSettings{}, err
+	}
+	if s.truncatedBody, err = internal.ParseTruncatedBodyPolicy(a.TruncatedBody); err != nil {
+		return appSettings{}, err
+	}
+	if s.interruptionFields, err = internal.ParseInterruptionFields(a.InterruptionFields); err != nil {
+		return appSettings{}, err
+	}
+	if s.attackRules, err = a.AttackRules.attackRules(); err != nil {
+		return appSettings{}, err
+	}
+	if s.directivesFiles, err = directivesFiles(a.DirectivesFiles, a.DirectivesDir); err != nil {
+		return appSettings{}, err
+	}
+	return s, nil
 }
 
-func (c *config) reloadConfig(a *internal.Agent) (*config, error) {
+func (c config) hasApplication(name string) bool {
+	for _, app := range c.Applications {
+		if app.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bindList accepts a single bind address or a list of them.
+type bindList []string
+
+func (b *bindList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*b = bindList{value.Value}
+		return nil
+	}
+
+	var binds []string
+	if err := value.Decode(&binds); err != nil {
+		return err
+	}
+	*b = binds
+	return nil
+}
+
+// idGeneratorConfig accepts the generator type as a scalar, or a mapping
+// to configure the counter generator.
+type idGeneratorConfig struct {
+	Type   string `yaml:"type"`
+	Prefix string `yaml:"prefix"`
+	NodeID string `yaml:"node_id"`
+}
+
+func (c *idGeneratorConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		c.Type = value.Value
+		return nil
+	}
+
+	// Decode does not inherit KnownFields from the config decoder.
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		switch key := value.Content[i]; key.Value {
+		case "type", "prefix", "node_id":
+		default:
+			return fmt.Errorf("line %d: field %s not found in id_generator", key.Line, key.Value)
+		}
+	}
+	type plain idGeneratorConfig
+	return value.Decode((*plain)(c))
+}
+
+func (c idGeneratorConfig) newIDGenerator() (internal.IDGenerator, error) {
+	return internal.IDGeneratorConfig{
+		Type:   c.Type,
+		Prefix: c.Prefix,
+		NodeID: c.NodeID,
+	}.NewIDGenerator()
+}
+
+// attackRulesConfig selects attack rules by id, by range like
+// 100000-100999 or by tag pattern like attack-*.
+type attackRulesConfig struct {
+	IDs    []int    `yaml:"ids"`
+	Ranges []string `yaml:"ranges"`
+	Tags   []string `yaml:"tags"`
+}
+
+func (c attackRulesConfig) attackRules() (internal.AttackRules, error) {
+	rules := internal.AttackRules{
+		IDs:  c.IDs,
+		Tags: c.Tags,
+	}
+	for _, r := range c.Ranges {
+		rng, err := internal.ParseRuleIDRange(r)
+		if err != nil {
+			return internal.AttackRules{}, fmt.Errorf("attack_rules: %v", err)
+		}
+		rules.Ranges = append(rules.Ranges, rng)
+	}
+	return rules, nil
+}
+
+// reloadSummary lists the applications by what a reload did to them.
+type reloadSummary struct {
+	// Reloaded applications are new or were rebuilt because their
+	// configuration changed.
+	Reloaded  []string `json:"reloaded"`
+	Unchanged []string `json:"unchanged"`
+	Removed   []string `json:"removed"`
+}
+
+// reloadResult is the outcome of a reload handled by the main loop.
+type reloadResult struct {
+	summary reloadSummary
+	err     error
+}
+
+func newReloadSummary(oldApps, newApps map[string]*internal.Application) reloadSummary {
+	summary := reloadSummary{
+		Reloaded:  []string{},
+		Unchanged: []string{},
+		Removed:   []string{},
+	}
+	for name, app := range newApps {
+		if oldApps[name] == app {
+			summary.Unchanged = append(summary.Unchanged, name)
+		} else {
+			summary.Reloaded = append(summary.Reloaded, name)
+		}
+	}
+	for name := range oldApps {
+		if _, ok := newApps[name]; !ok {
+			summary.Removed = append(summary.Removed, name)
+		}
+	}
+	slices.Sort(summary.Reloaded)
+	slices.Sort(summary.Unchanged)
+	slices.Sort(summary.Removed)
+	return summary
+}
+
+func (c *config) reloadConfig(a *internal.Agent, ls *listenerSet) (*config, reloadSummary, error) {
 	newCfg, err := readConfig()
 	if err != nil {
-		return nil, fmt.Errorf("error loading configuration: %w", err)
+		return nil, reloadSummary{}, fmt.Errorf("error loading configuration: %w", err)
 	}
 
 	if c.Log != newCfg.Log {
 		newLogger, err := newCfg.Log.newLogger()
 		if err != nil {
-			return nil, fmt.Errorf("error creating new global logger: %w", err)
+			return nil, reloadSummary{}, fmt.Errorf("error creating new global logger: %w", err)
 		}
 		globalLogger = newLogger
 	}
 
-	if c.Bind != newCfg.Bind {
-		return nil, fmt.Errorf("changing bind is not supported yet")
+	current := a.CurrentApplications()
+	apps, err := newCfg.newApplications(current)
+	if err != nil {
+		return nil, reloadSummary{}, fmt.Errorf("error applying configuration: %w", err)
 	}
 
-	apps, err := newCfg.newApplications()
-	if err != nil {
-		return nil, fmt.Errorf("error applying configuration: %w", err)
+	if err := ls.update(newCfg.Bind, newCfg.perm); err != nil {
+		closeNewApplications(apps, current)
+		return nil, reloadSummary{}, fmt.Errorf("error applying bind addresses: %w", err)
 	}
 
-	a.ReplaceApplications(apps)
-	globalLogger.Info().Msg("Configuration successfully reloaded")
-	return newCfg, nil
+	a.ReplaceApplications(apps, apps[newCfg.DefaultApplication])
+	a.ReplaceRoutes(newCfg.routes)
+	a.ReplaceOnError(newCfg.onErrorAction)
+
+	summary := newReloadSummary(current, apps)
+	globalLogger.Info().
+		Strs("reloaded", summary.Reloaded).
+		Strs("unchanged", summary.Unchanged).
+		Strs("removed", summary.Removed).
+		Msg("Configuration successfully reloaded")
+	return newCfg, summary, nil
 }
 
-func (c *config) watchConfig(a *internal.Agent) error {
+// watchConfig calls reload whenever the configmap mounted at the config
+// directory, or a directory with directives files, is updated. The
+// directories are taken from watchDirs after each reload.
+func watchConfig(reload func() error, watchDirs func() []string) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return fmt.Errorf("failed to create fsnotify watcher: %w", err)
@@ -109,11 +457,29 @@ func (c *config) watchConfig(a *internal.Agent) error {
 	defer watcher.Close()
 
 	// configmap mounts are symlinks
-	// so we have to watch the parent directory instead of the file itself
-	configDir := filepath.Dir(configPath)
-	err = watcher.Add(configDir)
-	if err != nil {
-		return fmt.Errorf("failed to add config directory to fsnotify watcher: %w", err)
+	// so we have to watch the parent directories instead of the files themselves
+	watched := make(map[string]bool)
+	updateWatches := func() error {
+		dirs := watchDirs()
+		for dir := range watched {
+			if !slices.Contains(dirs, dir) {
+				_ = watcher.Remove(dir)
+				delete(watched, dir)
+			}
+		}
+		for _, dir := range dirs {
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				return fmt.Errorf("failed to add directory %s to fsnotify watcher: %w", dir, err)
+			}
+			watched[dir] = true
+		}
+		return nil
+	}
+	if err := updateWatches(); err != nil {
+		return err
 	}
 
 	for {
@@ -125,21 +491,22 @@ func (c *config) watchConfig(a *internal.Agent) error {
 			// on configmap change, the directory symlink is recreated
 			// so we have to catch this event and readd the directory back to watcher
 			if event.Op == fsnotify.Remove {
-				globalLogger.Info().Msg("Config directory updated, reloading configuration...")
-				err = watcher.Remove(configDir)
+				dir := filepath.Dir(event.Name)
+				globalLogger.Info().Str("dir", dir).Msg("Config directory updated, reloading configuration...")
+				err = watcher.Remove(dir)
 				if err != nil {
-					return fmt.Errorf("failed to remove config directory from fsnotify watcher: %w", err)
+					return fmt.Errorf("failed to remove directory %s from fsnotify watcher: %w", dir, err)
 				}
-				err = watcher.Add(configDir)
+				err = watcher.Add(dir)
 				if err != nil {
-					return fmt.Errorf("failed to add config directory to fsnotify watcher: %w", err)
+					return fmt.Errorf("failed to add directory %s to fsnotify watcher: %w", dir, err)
 				}
-				newCfg, err := c.reloadConfig(a)
-				if err != nil {
-					globalLogger.Error().Err(err).Msg("Failed to reload configuration, using old configuration")
-					continue
+				// reload logs the error
+				if reload() == nil {
+					if err := updateWatches(); err != nil {
+						return err
+					}
 				}
-				c = newCfg
 			}
 		case err, ok := <-watcher.Errors:
 			if !ok {
@@ -150,26 +517,80 @@ func (c *config) watchConfig(a *internal.Agent) error {
 	}
 }
 
-func (c config) newApplications() (map[string]*internal.Application, error) {
+// watchDirs returns the directories of the config file, the include_dir
+// and of all directives files.
+func (c config) watchDirs() []string {
+	dirs := []string{resolveConfigPath(".")}
+	add := func(dir string) {
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	if c.IncludeDir != "" {
+		add(resolveConfigPath(c.IncludeDir))
+	}
+	for _, a := range c.Applications {
+		for _, file := range a.settings.directivesFiles {
+			add(filepath.Dir(file))
+		}
+		if a.DirectivesDir != "" {
+			add(resolveConfigPath(a.DirectivesDir))
+		}
+	}
+	return dirs
+}
+
+// newApplications creates the applications of the config. An application
+// of current whose configuration is unchanged is kept, so it is neither
+// compiled again nor loses its cached transactions.
+func (c config) newApplications(current map[string]*internal.Application) (_ map[string]*internal.Application, err error) {
 	allApps := make(map[string]*internal.Application)
+	defer func() {
+		if err != nil {
+			closeNewApplications(allApps, current)
+		}
+	}()
+
+	for _, a := range c.Applications {
+		directivesHash, err := internal.DirectivesHash(a.settings.directives, a.settings.directivesFiles)
+		if err != nil {
+			return nil, fmt.Errorf("application %q: %v", a.Name, err)
+		}
+		configHash, err := appConfigHash(a, a.settings.onError, directivesHash)
+		if err != nil {
+			return nil, fmt.Errorf("application %q: %v", a.Name, err)
+		}
+		if app, ok := current[a.Name]; ok && app.ConfigHash == configHash {
+			allApps[a.Name] = app
+			continue
+		}
 
-	for name, a := range c.Applications {
 		logger, err := a.Log.newLogger()
 		if err != nil {
-			return nil, fmt.Errorf("creating logger for application %q: %v", name, err)
+			return nil, fmt.Errorf("creating logger for application %q: %v", a.Name, err)
 		}
 
 		appConfig := internal.AppConfig{
-			Logger:         logger,
-			Directives:     a.Directives,
-			ResponseCheck:  a.ResponseCheck,
-			LogFormat:      a.Log.Format,
-			TransactionTTL: time.Duration(a.TransactionTTLMS) * time.Millisecond,
+			Name:               a.Name,
+			Logger:             logger,
+			Directives:         a.settings.directives,
+			ResponseCheck:      a.ResponseCheck,
+			LogFormat:          a.Log.Format,
+			TransactionTTL:     time.Duration(a.TransactionTTLMS) * time.Millisecond,
+			OnError:            a.settings.onError,
+			IDGenerator:        a.settings.idGenerator,
+			MaxIDLength:        a.IDMaxLength,
+			TruncatedBody:      a.settings.truncatedBody,
+			InterruptionFields: a.settings.interruptionFields,
+			AttackRules:        a.settings.attackRules,
+			DirectivesFiles:    a.settings.directivesFiles,
+			DirectivesHash:     directivesHash,
+			ConfigHash:         configHash,
 		}
 
 		application, err := appConfig.NewApplication()
 		if err != nil {
-			return nil, fmt.Errorf("initializing application %q: %v", name, err)
+			return nil, fmt.Errorf("initializing application %q: %v", a.Name, err)
 		}
 
 		allApps[a.Name] = application
@@ -178,6 +599,117 @@ func (c config) newApplications() (map[string]*internal.Application, error) {
 	return allApps, nil
 }
 
+// closeNewApplications closes the applications of apps which are not kept
+// from current, after the config they were created for was not applied.
+func closeNewApplications(apps, current map[string]*internal.Application) {
+	for name, app := range apps {
+		if current[name] != app {
+			app.Close()
+		}
+	}
+}
+
+// appConfigHash hashes the settings of an application, its effective
+// on_error, and the DirectivesHash of its directives.
+func appConfigHash(settings any, onError internal.FailAction, directivesHash string) (string, error) {
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(encoded)
+	fmt.Fprintf(h, "\x00%s\x00%s", onError, directivesHash)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// socketPermissions resolves the mode and ownership for unix sockets.
+func (c config) socketPermissions() (socketPermissions, error) {
+	perm := socketPermissions{uid: -1, gid: -1}
+	if c.BindMode != "" {
+		mode, err := strconv.ParseUint(c.BindMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return perm, fmt.Errorf("invalid bind_mode %q: expected octal permissions like 0660", c.BindMode)
+		}
+		perm.mode = os.FileMode(mode)
+	}
+	if c.BindOwner != "" {
+		uid, err := lookupID(c.BindOwner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return perm, fmt.Errorf("invalid bind_owner: %v", err)
+		}
+		perm.uid = uid
+	}
+	if c.BindGroup != "" {
+		gid, err := lookupID(c.BindGroup, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return perm, fmt.Errorf("invalid bind_group: %v", err)
+		}
+		perm.gid = gid
+	}
+	return perm, nil
+}
+
+// lookupID accepts a numeric id or a name resolved with lookup.
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// redacted returns the config in a form which is safe to show. The
+// directives and all values containing a secret read from a file are
+// redacted.
+func (c config) redacted() (*yaml.Node, error) {
+	const redactedValue = "[redacted]"
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	c.Applications = slices.Clone(c.Applications)
+	for i := range c.Applications {
+		redact(&c.Applications[i].Directives)
+		redact(&c.Applications[i].PrependDirectives)
+		redact(&c.Applications[i].AppendDirectives)
+	}
+	c.Templates = slices.Clone(c.Templates)
+	for i := range c.Templates {
+		redact(&c.Templates[i].Directives)
+	}
+
+	var node yaml.Node
+	if err := node.Encode(c); err != nil {
+		return nil, err
+	}
+	redactSecrets(&node, c.secrets, redactedValue)
+	return &node, nil
+}
+
+func (c config) shutdownGracePeriod() time.Duration {
+	const defaultShutdownGracePeriod = 5 * time.Second
+	if c.ShutdownGracePeriodMS <= 0 {
+		return defaultShutdownGracePeriod
+	}
+	return time.Duration(c.ShutdownGracePeriodMS) * time.Millisecond
+}
+
 type logConfig struct {
 	Level  string `yaml:"log_level"`
 	File   string `yaml:"log_file"`
@@ -187,22 +719,22 @@ type logConfig struct {
 func (lc logConfig) outputWriter() (io.Writer, error) {
 	var out io.Writer
 	switch lc.File {
-		case "":
-			fallthrough
-		case "/dev/stdout":
-			out = os.Stdout
-		case "/dev/stderr":
-			out = os.Stderr
-		case "/dev/null":
-			out = io.Discard
-		default:
-			// TODO: Close the handle if not used anymore.
-			// Currently these are leaked as soon as we reload.
-			f, err := os.OpenFile(lc.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-			if err != nil {
-				return nil, err
-			}
-			out = f
+	case "":
+		fallthrough
+	case "/dev/stdout":
+		out = os.Stdout
+	case "/dev/stderr":
+		out = os.Stderr
+	case "/dev/null":
+		out = io.Discard
+	default:
+		// TODO: Close the handle if not used anymore.
+		// Currently these are leaked as soon as we reload.
+		f, err := os.OpenFile(lc.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+		out = f
 	}
 	return out, nil
 }
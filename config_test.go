@@ -0,0 +1,932 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/corazawaf/coraza-spoa/internal"
+)
+
+func TestBindList_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    bindList
+		wantErr bool
+	}{
+		{
+			name: "single address",
+			yaml: `bind: 127.0.0.1:9000`,
+			want: bindList{"127.0.0.1:9000"},
+		},
+		{
+			name: "list",
+			yaml: "bind:\n  - 127.0.0.1:9000\n  - unix:///run/coraza.sock",
+			want: bindList{"127.0.0.1:9000", "unix:///run/coraza.sock"},
+		},
+		{
+			name: "empty list",
+			yaml: `bind: []`,
+			want: bindList{},
+		},
+		{
+			name:    "mapping",
+			yaml:    "bind:\n  address: 127.0.0.1:9000",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg struct {
+				Bind bindList `yaml:"bind"`
+			}
+			err := yaml.Unmarshal([]byte(tt.yaml), &cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", cfg.Bind)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cfg.Bind, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, cfg.Bind)
+			}
+		})
+	}
+}
+
+// setConfigPath points configPath, which relative paths are resolved
+// against, to a file in dir for the duration of the test.
+func setConfigPath(t *testing.T, dir string) {
+	t.Helper()
+
+	old := configPath
+	configPath = filepath.Join(dir, "coraza-spoa.yaml")
+	t.Cleanup(func() {
+		configPath = old
+	})
+}
+
+// writeFiles creates the files with their content below dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDirectivesFiles(t *testing.T) {
+	dir := t.TempDir()
+	setConfigPath(t, dir)
+	writeFiles(t, dir, map[string]string{
+		"rules/b.conf":             "",
+		"rules/a.conf":             "",
+		"rules/c.txt":              "",
+		"extra.conf":               "",
+		"conf.d/20-tuning.conf":    "",
+		"conf.d/10-setup.conf":     "",
+		"conf.d/README.md":         "",
+		"conf.d/nested/x.conf":     "",
+		"conf.d/nested.conf/.keep": "",
+	})
+	abs := func(names ...string) []string {
+		paths := make([]string, 0, len(names))
+		for _, name := range names {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+		return paths
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		dir      string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "files as listed",
+			patterns: []string{"extra.conf", "rules/b.conf", "rules/a.conf"},
+			want:     abs("extra.conf", "rules/b.conf", "rules/a.conf"),
+		},
+		{
+			name:     "absolute path",
+			patterns: abs("extra.conf"),
+			want:     abs("extra.conf"),
+		},
+		{
+			name:     "glob sorted",
+			patterns: []string{"rules/*.conf", "extra.conf"},
+			want:     abs("rules/a.conf", "rules/b.conf", "extra.conf"),
+		},
+		{
+			name:     "duplicates loaded once",
+			patterns: []string{"rules/b.conf", "rules/*.conf", "rules/b.conf"},
+			want:     abs("rules/b.conf", "rules/a.conf"),
+		},
+		{
+			name:     "glob without matches",
+			patterns: []string{"rules/*.rules"},
+			want:     nil,
+		},
+		{
+			name:     "directory after files",
+			patterns: []string{"extra.conf"},
+			dir:      "conf.d",
+			want:     abs("extra.conf", "conf.d/10-setup.conf", "conf.d/20-tuning.conf"),
+		},
+		{
+			name:     "directory file listed before",
+			patterns: []string{"conf.d/20-tuning.conf"},
+			dir:      "conf.d",
+			want:     abs("conf.d/20-tuning.conf", "conf.d/10-setup.conf"),
+		},
+		{
+			name:     "missing file",
+			patterns: []string{"missing.conf"},
+			wantErr:  true,
+		},
+		{
+			name:     "directory as file",
+			patterns: []string{"rules"},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid glob",
+			patterns: []string{"rules/[.conf"},
+			wantErr:  true,
+		},
+		{
+			name:    "missing directory",
+			dir:     "missing.d",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := directivesFiles(tt.patterns, tt.dir)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfig_TemplateDirectives(t *testing.T) {
+	cfg := config{Templates: []templateConfig{
+		{Name: "base", Directives: "SecRuleEngine On"},
+		{Name: "crs", Extends: "base", Directives: "Include @owasp_crs/*.conf"},
+		{Name: "api", Extends: "crs", Directives: "SecRuleRemoveById 920350"},
+		{Name: "empty", Extends: "base"},
+		{Name: "missing-parent", Extends: "missing"},
+		{Name: "self", Extends: "self"},
+		{Name: "loop-a", Extends: "loop-b"},
+		{Name: "loop-b", Extends: "loop-a"},
+	}}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr string
+	}{
+		{name: "", want: ""},
+		{name: "base", want: "SecRuleEngine On"},
+		{name: "api", want: "SecRuleEngine On\nInclude @owasp_crs/*.conf\nSecRuleRemoveById 920350"},
+		{name: "empty", want: "SecRuleEngine On"},
+		{name: "missing", wantErr: "template not found among defined templates: missing"},
+		{name: "missing-parent", wantErr: "template not found among defined templates: missing"},
+		{name: "self", wantErr: `template "self" extends itself: self -> self`},
+		{name: "loop-a", wantErr: `template "loop-a" extends itself: loop-a -> loop-b -> loop-a`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cfg.templateDirectives(tt.name)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateTemplates(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates []templateConfig
+		wantErr   bool
+	}{
+		{
+			name: "valid",
+			templates: []templateConfig{
+				{Name: "base"},
+				{Name: "crs", Extends: "base"},
+			},
+		},
+		{
+			name:      "missing name",
+			templates: []templateConfig{{Directives: "SecRuleEngine On"}},
+			wantErr:   true,
+		},
+		{
+			name:      "duplicate name",
+			templates: []templateConfig{{Name: "base"}, {Name: "base"}},
+			wantErr:   true,
+		},
+		{
+			name:      "cycle",
+			templates: []templateConfig{{Name: "a", Extends: "b"}, {Name: "b", Extends: "a"}},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := config{Templates: tt.templates}.validateTemplates()
+			if tt.wantErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestJoinDirectives(t *testing.T) {
+	tests := []struct {
+		name       string
+		directives []string
+		want       string
+	}{
+		{name: "none", want: ""},
+		{name: "empty", directives: []string{"", ""}, want: ""},
+		{name: "single", directives: []string{"SecRuleEngine On"}, want: "SecRuleEngine On"},
+		{name: "line break added", directives: []string{"a", "b"}, want: "a\nb"},
+		{name: "line break kept", directives: []string{"a\n", "b\n"}, want: "a\nb\n"},
+		{name: "empty skipped", directives: []string{"", "a", "", "b"}, want: "a\nb"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := joinDirectives(tt.directives...); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfig_ParseApplicationDirectives(t *testing.T) {
+	var cfg config
+	err := yaml.Unmarshal([]byte(`
+templates:
+  - name: base
+    directives: SecRuleEngine On
+applications:
+  - name: extends
+    extends: base
+    prepend_directives: SecDebugLogLevel 0
+    append_directives: SecRuleRemoveById 920350
+  - name: inline
+    directives: SecRuleEngine DetectionOnly
+  - name: both
+    extends: base
+    directives: SecRuleEngine Off
+  - name: missing
+    extends: missing
+`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := cfg.parseApplication(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SecDebugLogLevel 0\nSecRuleEngine On\nSecRuleRemoveById 920350"; settings.directives != want {
+		t.Errorf("expected directives %q, got %q", want, settings.directives)
+	}
+
+	settings, err = cfg.parseApplication(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SecRuleEngine DetectionOnly"; settings.directives != want {
+		t.Errorf("expected directives %q, got %q", want, settings.directives)
+	}
+
+	for _, i := range []int{2, 3} {
+		if _, err := cfg.parseApplication(i); err == nil {
+			t.Errorf("expected an error for application %q", cfg.Applications[i].Name)
+		}
+	}
+}
+
+func TestConfig_IncludeApplications(t *testing.T) {
+	dir := t.TempDir()
+	setConfigPath(t, dir)
+	writeFiles(t, dir, map[string]string{
+		"apps.d/20-b.yml": "applications:\n  - name: b\n",
+		"apps.d/10-a.yaml": `
+applications:
+  - name: a1
+    log_level: ${file:token}
+  - name: a2
+`,
+		"apps.d/15-empty.yaml": "",
+		"apps.d/README.md":     "applications: not yaml",
+		"apps.d/sub/30-c.yaml": "applications:\n  - name: c\n",
+		"token":                "info-token\n",
+	})
+
+	cfg := config{IncludeDir: "apps.d"}
+	var in interpolator
+	if err := cfg.includeApplications(&in); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, a := range cfg.Applications {
+		names = append(names, a.Name)
+	}
+	if want := []string{"a1", "a2", "b"}; !slices.Equal(names, want) {
+		t.Errorf("expected applications %q, got %q", want, names)
+	}
+	if len(cfg.positions.applications) != 3 {
+		t.Fatalf("expected 3 application positions, got %d", len(cfg.positions.applications))
+	}
+	want := []string{
+		filepath.Join(dir, "apps.d/10-a.yaml") + ":3",
+		filepath.Join(dir, "apps.d/10-a.yaml") + ":5",
+		filepath.Join(dir, "apps.d/20-b.yml") + ":2",
+	}
+	for i, w := range want {
+		if got := cfg.positions.application(i).key("name").String(); got != w {
+			t.Errorf("expected application %d at %s, got %s", i, w, got)
+		}
+	}
+	if !slices.Equal(in.secrets, []string{"info-token"}) {
+		t.Errorf("expected the interpolated file to be a secret, got %q", in.secrets)
+	}
+}
+
+func TestConfig_IncludeApplicationsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{name: "missing dir"},
+		{name: "global setting", files: map[string]string{"apps.d/a.yaml": "on_error: deny\n"}},
+		{name: "unknown field", files: map[string]string{"apps.d/a.yaml": "applications:\n  - name: a\n    unknown: 1\n"}},
+		{name: "undefined variable", files: map[string]string{"apps.d/a.yaml": "applications:\n  - name: ${CORAZA_UNDEFINED}\n"}},
+		{name: "invalid yaml", files: map[string]string{"apps.d/a.yaml": "applications: [\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			setConfigPath(t, dir)
+			writeFiles(t, dir, tt.files)
+
+			cfg := config{IncludeDir: "apps.d"}
+			if err := cfg.includeApplications(&interpolator{}); err == nil {
+				t.Errorf("expected an error, got applications %+v", cfg.Applications)
+			}
+		})
+	}
+}
+
+func TestIncludeFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"b.yml":        "",
+		"a.yaml":       "",
+		"c.yaml.bak":   "",
+		"d.json":       "",
+		"sub/e.yaml":   "",
+		"dir.yaml/f":   "",
+		"UPPER.YAML":   "",
+		".hidden.yaml": "",
+	})
+
+	files, err := includeFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, ".hidden.yaml"),
+		filepath.Join(dir, "a.yaml"),
+		filepath.Join(dir, "b.yml"),
+	}
+	if !slices.Equal(files, want) {
+		t.Errorf("expected files %q, got %q", want, files)
+	}
+
+	if _, err := includeFiles(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestCheckFragmentKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{name: "applications", yaml: "applications:\n  - name: a\n"},
+		{name: "empty", yaml: ""},
+		{name: "not a mapping", yaml: "- name: a\n"},
+		{
+			name:    "global setting",
+			yaml:    "applications: []\n\nbind: 0.0.0.0:9000\n",
+			wantErr: "line 3: bind cannot be set in an included file, only applications",
+		},
+		{
+			name:    "templates",
+			yaml:    "templates:\n  - name: base\n",
+			wantErr: "line 1: templates cannot be set in an included file, only applications",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root yaml.Node
+			if err := yaml.Unmarshal([]byte(tt.yaml), &root); err != nil {
+				t.Fatal(err)
+			}
+			err := checkFragmentKeys(&root)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConfig_CheckSemantics(t *testing.T) {
+	const global = "log_level: info\nlog_format: console\n"
+	const app = "    log_level: info\n    log_format: json\n"
+
+	tests := []struct {
+		name     string
+		yaml     string
+		wantErrs []string
+	}{
+		{
+			name: "valid",
+			yaml: global + "applications:\n  - name: a\n" + app + "    response_check: true\n    transaction_ttl_ms: 1000\n",
+		},
+		{
+			name:     "global log format",
+			yaml:     "log_level: info\nlog_format: text\n",
+			wantErrs: []string{`coraza-spoa.yaml:2: unknown log_format "text", expected console or json`},
+		},
+		{
+			name:     "global log level",
+			yaml:     "log_format: json\n\nlog_level: verbose\n",
+			wantErrs: []string{`coraza-spoa.yaml:3: unknown log_level "verbose"`},
+		},
+		{
+			name: "duplicate names",
+			yaml: global + "applications:\n  - name: a\n" + app + "  - name: b\n" + app + "  - name: a\n" + app,
+			wantErrs: []string{
+				`coraza-spoa.yaml:10: application "a" is already defined at coraza-spoa.yaml:4`,
+			},
+		},
+		{
+			name: "application log level",
+			yaml: global + "applications:\n  - name: a\n    log_format: json\n    log_level: loud\n",
+			wantErrs: []string{
+				`coraza-spoa.yaml:6: application "a": unknown log_level "loud"`,
+			},
+		},
+		{
+			name: "response check without ttl",
+			yaml: global + "applications:\n  - name: a\n" + app + "    response_check: true\n    transaction_ttl_ms: 0\n",
+			wantErrs: []string{
+				`coraza-spoa.yaml:8: application "a": response_check requires a transaction_ttl_ms greater than 0`,
+			},
+		},
+		{
+			name: "response check without ttl key",
+			yaml: global + "applications:\n  - name: a\n" + app + "    response_check: true\n",
+			wantErrs: []string{
+				`coraza-spoa.yaml:4: application "a": response_check requires a transaction_ttl_ms greater than 0`,
+			},
+		},
+		{
+			name: "all errors",
+			yaml: "log_level: info\nlog_format: text\napplications:\n  - name: a\n    log_format: json\n    log_level: loud\n    response_check: true\n",
+			wantErrs: []string{
+				`coraza-spoa.yaml:2: unknown log_format "text"`,
+				`coraza-spoa.yaml:6: application "a": unknown log_level "loud"`,
+				`coraza-spoa.yaml:4: application "a": response_check requires`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root yaml.Node
+			if err := yaml.Unmarshal([]byte(tt.yaml), &root); err != nil {
+				t.Fatal(err)
+			}
+			var cfg config
+			if err := root.Decode(&cfg); err != nil {
+				t.Fatal(err)
+			}
+			cfg.positions.readPositions("coraza-spoa.yaml", &root)
+
+			err := cfg.checkSemantics()
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := len(strings.Split(err.Error(), "\n")); got != len(tt.wantErrs) {
+				t.Errorf("expected %d errors, got %d: %v", len(tt.wantErrs), got, err)
+			}
+			for _, want := range tt.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error %q, got %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigPositions(t *testing.T) {
+	var root yaml.Node
+	err := yaml.Unmarshal([]byte(`bind: 0.0.0.0:9000
+applications:
+  - name: a
+
+    log_level: info
+  - {name: b}
+`), &root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p configPositions
+	p.readPositions("main.yaml", &root)
+	// a second file only adds applications
+	if err := yaml.Unmarshal([]byte("applications:\n  - name: c\n"), &root); err != nil {
+		t.Fatal(err)
+	}
+	p.readPositions("include.yaml", &root)
+
+	setConfigPath(t, "/etc/coraza-spoa")
+	tests := []struct {
+		name string
+		got  position
+		want string
+	}{
+		{name: "root key", got: p.root.key("bind"), want: "main.yaml:1"},
+		{name: "unset root key", got: p.root.key("on_error"), want: "main.yaml:1"},
+		{name: "application key", got: p.application(0).key("log_level"), want: "main.yaml:5"},
+		{name: "unset application key", got: p.application(0).key("on_error"), want: "main.yaml:3"},
+		{name: "flow mapping", got: p.application(1).key("name"), want: "main.yaml:6"},
+		{name: "included application", got: p.application(2).key("name"), want: "include.yaml:2"},
+		{name: "unknown application", got: p.application(3).key("name"), want: "/etc/coraza-spoa/coraza-spoa.yaml"},
+		{name: "without line", got: position{file: "main.yaml"}, want: "main.yaml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.got.String(); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRuleEngineOff(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"on.conf":   "SecRuleEngine On\n",
+		"off.conf":  "# disable\nSecRuleEngine Off\n",
+		"rule.conf": "SecRule REQUEST_URI \"@streq /\" \"id:1,deny\"\n",
+	})
+	on := filepath.Join(dir, "on.conf")
+	off := filepath.Join(dir, "off.conf")
+	rule := filepath.Join(dir, "rule.conf")
+
+	tests := []struct {
+		name       string
+		directives string
+		files      []string
+		want       bool
+	}{
+		{name: "unset", directives: "SecRequestBodyAccess On"},
+		{name: "on", directives: "SecRuleEngine On"},
+		{name: "off", directives: "SecRuleEngine Off", want: true},
+		{name: "case insensitive", directives: `secruleengine "off"`, want: true},
+		{name: "last wins", directives: "SecRuleEngine Off\nSecRuleEngine DetectionOnly"},
+		{name: "file turns off", directives: "SecRuleEngine On", files: []string{off}, want: true},
+		{name: "file turns on", directives: "SecRuleEngine Off", files: []string{off, on}},
+		{name: "file without engine", directives: "SecRuleEngine Off", files: []string{rule}, want: true},
+		{name: "missing file", directives: "SecRuleEngine Off", files: []string{filepath.Join(dir, "missing.conf")}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ruleEngineOff(tt.directives, tt.files); got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema := configSchema()
+	if schema["additionalProperties"] != false {
+		t.Error("expected unknown settings to be rejected")
+	}
+
+	properties := schema["properties"].(map[string]any)
+	// the inline log settings are top-level properties
+	for _, key := range []string{"bind", "log_level", "log_format", "on_error", "applications", "templates", "include_dir", "routes"} {
+		if _, ok := properties[key]; !ok {
+			t.Errorf("expected property %s", key)
+		}
+	}
+	if _, ok := properties["secrets"]; ok {
+		t.Error("expected unexported fields to be skipped")
+	}
+
+	if _, ok := properties["bind"].(map[string]any)["oneOf"]; !ok {
+		t.Errorf("expected bind to be a string or a list, got %v", properties["bind"])
+	}
+
+	applications := properties["applications"].(map[string]any)
+	app := applications["items"].(map[string]any)
+	appProperties := app["properties"].(map[string]any)
+	for _, key := range []string{"name", "log_level", "directives_files", "id_generator", "interruption_fields"} {
+		if _, ok := appProperties[key]; !ok {
+			t.Errorf("expected application property %s", key)
+		}
+	}
+
+	// enums accept a ${...} reference as well
+	onError := appProperties["on_error"].(map[string]any)["anyOf"].([]any)
+	enum := onError[0].(map[string]any)["enum"].([]string)
+	if !slices.Equal(enum, []string{"allow", "deny"}) {
+		t.Errorf("expected on_error enum [allow deny], got %v", enum)
+	}
+	if pattern := onError[1].(map[string]any)["pattern"]; pattern != `\$\{` {
+		t.Errorf("expected a reference pattern, got %v", pattern)
+	}
+
+	fields := appProperties["interruption_fields"].(map[string]any)
+	if fields["type"] != "array" {
+		t.Errorf("expected interruption_fields to be an array, got %v", fields)
+	}
+}
+
+func TestConfig_NewApplications(t *testing.T) {
+	dir := t.TempDir()
+	setConfigPath(t, dir)
+	const apps = `
+log_level: info
+log_format: console
+applications:
+  - name: files
+    log_level: info
+    log_format: console
+    directives_files: [rules.conf]
+  - name: inline
+    log_level: info
+    log_format: console
+    directives: SecRuleEngine On
+  - name: deny
+    log_level: info
+    log_format: console
+    on_error: deny
+    directives: SecRuleEngine On
+`
+	writeFiles(t, dir, map[string]string{
+		"coraza-spoa.yaml": apps,
+		"rules.conf":       "SecRuleEngine On\n",
+	})
+
+	var current map[string]*internal.Application
+	t.Cleanup(func() {
+		for _, app := range current {
+			app.Close()
+		}
+	})
+	reload := func() map[string]*internal.Application {
+		t.Helper()
+		cfg, err := readConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := cfg.newApplications(current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		closeNewApplications(current, next)
+		prev := current
+		current = next
+		return prev
+	}
+	// rebuilt checks which applications were created again by a reload.
+	rebuilt := func(prev map[string]*internal.Application, names ...string) {
+		t.Helper()
+		for name, app := range current {
+			if got, want := app != prev[name], slices.Contains(names, name); got != want {
+				t.Errorf("expected application %q to be rebuilt: %t, got %t", name, want, got)
+			}
+		}
+	}
+
+	reload()
+	if len(current) != 3 {
+		t.Fatalf("expected 3 applications, got %d", len(current))
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		rebuilt(reload())
+	})
+
+	t.Run("directives file", func(t *testing.T) {
+		writeFiles(t, dir, map[string]string{"rules.conf": "SecRuleEngine DetectionOnly\n"})
+		rebuilt(reload(), "files")
+
+		hash, err := internal.DirectivesHash("", []string{filepath.Join(dir, "rules.conf")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := current["files"].DirectivesHash; got != hash {
+			t.Errorf("expected directives hash %s, got %s", hash, got)
+		}
+	})
+
+	t.Run("global on_error", func(t *testing.T) {
+		writeFiles(t, dir, map[string]string{"coraza-spoa.yaml": "on_error: allow\n" + apps})
+		rebuilt(reload(), "files", "inline")
+		if current["inline"].OnError != internal.FailActionAllow {
+			t.Errorf("expected the inherited on_error to be allow, got %s", current["inline"].OnError)
+		}
+	})
+
+	t.Run("application setting", func(t *testing.T) {
+		writeFiles(t, dir, map[string]string{
+			"coraza-spoa.yaml": "on_error: allow\n" + strings.Replace(apps, "SecRuleEngine On", "SecRuleEngine Off", 1),
+		})
+		rebuilt(reload(), "inline")
+	})
+}
+
+func TestAppConfigHash(t *testing.T) {
+	type settings struct {
+		Name          string
+		ResponseCheck bool
+	}
+	base := settings{Name: "app"}
+
+	hash := func(s settings, onError internal.FailAction, directivesHash string) string {
+		t.Helper()
+		h, err := appConfigHash(s, onError, directivesHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	want := hash(base, internal.FailActionDeny, "abc")
+	if got := hash(base, internal.FailActionDeny, "abc"); got != want {
+		t.Errorf("expected a stable hash %s, got %s", want, got)
+	}
+
+	tests := []struct {
+		name           string
+		settings       settings
+		onError        internal.FailAction
+		directivesHash string
+	}{
+		{name: "settings", settings: settings{Name: "app", ResponseCheck: true}, onError: internal.FailActionDeny, directivesHash: "abc"},
+		{name: "on_error", settings: base, onError: internal.FailActionAllow, directivesHash: "abc"},
+		{name: "directives", settings: base, onError: internal.FailActionDeny, directivesHash: "abd"},
+		// the separators keep the boundary between the values unambiguous
+		{name: "boundary", settings: base, onError: "den", directivesHash: "yabc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hash(tt.settings, tt.onError, tt.directivesHash); got == want {
+				t.Errorf("expected the hash to change, got %s", got)
+			}
+		})
+	}
+
+	if _, err := appConfigHash(func() {}, internal.FailActionDeny, "abc"); err == nil {
+		t.Error("expected an error for settings which cannot be encoded")
+	}
+}
+
+func TestDecodeConfigFile(t *testing.T) {
+	t.Setenv("CORAZA_TTL", "1000")
+
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			yaml: "on_error: deny\n\napplications:\n  - name: a\n    transaction_ttl_ms: ${CORAZA_TTL}\n    id_generator: {type: counter, prefix: waf-}\n",
+		},
+		{
+			name:    "unknown key",
+			yaml:    "on_error: deny\n\n\nbogus: 1\n",
+			wantErr: "line 4: field bogus not found in config",
+		},
+		{
+			name:    "unknown application key",
+			yaml:    "applications:\n\n  - name: a\n\n    transaction_ttl_ms: ${CORAZA_TTL}\n\n    bogus: 1\n",
+			wantErr: "line 7: field bogus not found in applications",
+		},
+		{
+			name:    "unknown nested key",
+			yaml:    "applications:\n  - name: a\n    attack_rules:\n      ids: [1]\n\n      bogus: 1\n",
+			wantErr: "line 6: field bogus not found in attack_rules",
+		},
+		{
+			name:    "unknown template key",
+			yaml:    "templates:\n  - name: base\n    bogus: 1\n",
+			wantErr: "line 3: field bogus not found in templates",
+		},
+		{
+			name:    "invalid type",
+			yaml:    "on_error: deny\n\napplications:\n  - name: a\n\n    response_check: maybe\n",
+			wantErr: "yaml: unmarshal errors:\n  line 6: cannot unmarshal !!str `maybe` into bool",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "coraza-spoa.yaml")
+			writeFiles(t, dir, map[string]string{"coraza-spoa.yaml": tt.yaml})
+
+			var cfg config
+			_, err := decodeConfigFile(path, &interpolator{}, &cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ttl := cfg.Applications[0].TransactionTTLMS; ttl != 1000 {
+					t.Errorf("expected the interpolated ttl 1000, got %d", ttl)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
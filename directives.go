@@ -0,0 +1,163 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// directivesFiles resolves the directives_files and the directives_dir of an
+// application. Relative paths are relative to the directory of the config
+// file. The files are returned in load order: the directives_files as
+// listed, with the matches of a glob sorted by name, followed by the *.conf
+// files in the directives_dir sorted by name. A file is only loaded once.
+func directivesFiles(patterns []string, dir string) ([]string, error) {
+	var files []string
+	add := func(file string) {
+		if !slices.Contains(files, file) {
+			files = append(files, file)
+		}
+	}
+
+	for _, pattern := range patterns {
+		pattern = resolveConfigPath(pattern)
+		if !hasGlobMeta(pattern) {
+			if err := checkDirectivesFile(pattern); err != nil {
+				return nil, fmt.Errorf("directives_files: %v", err)
+			}
+			add(pattern)
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("directives_files: invalid pattern %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			globalLogger.Warn().Str("pattern", pattern).Msg("directives_files pattern matches no files")
+		}
+		for _, match := range matches {
+			if err := checkDirectivesFile(match); err != nil {
+				return nil, fmt.Errorf("directives_files: %v", err)
+			}
+			add(match)
+		}
+	}
+
+	if dir != "" {
+		dir = resolveConfigPath(dir)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("directives_dir: %v", err)
+		}
+		// ReadDir sorts the entries by name
+		for _, e := range entries {
+			if e.IsDir() || filepath.Ext(e.Name()) != ".conf" {
+				continue
+			}
+			add(filepath.Join(dir, e.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+// resolveConfigPath makes a path relative to the directory of the config
+// file absolute.
+func resolveConfigPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	base, err := filepath.Abs(filepath.Dir(configPath))
+	if err != nil {
+		return filepath.Join(filepath.Dir(configPath), path)
+	}
+	return filepath.Join(base, path)
+}
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+func checkDirectivesFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// templateConfig holds directives shared by the applications extending it.
+// A template can extend another template, whose directives are loaded
+// first.
+type templateConfig struct {
+	Name       string `yaml:"name"`
+	Extends    string `yaml:"extends"`
+	Directives string `yaml:"directives"`
+}
+
+func (c config) validateTemplates() error {
+	names := make(map[string]bool, len(c.Templates))
+	for i, t := range c.Templates {
+		if t.Name == "" {
+			return fmt.Errorf("template %d: name is required", i)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("template %q is defined more than once", t.Name)
+		}
+		names[t.Name] = true
+	}
+	for _, t := range c.Templates {
+		if _, err := c.templateDirectives(t.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateDirectives returns the directives of a template, preceded by the
+// directives of the templates it extends. An empty name has no directives.
+func (c config) templateDirectives(name string) (string, error) {
+	var chain []string
+	var directives []string
+	for name != "" {
+		if slices.Contains(chain, name) {
+			return "", fmt.Errorf("template %q extends itself: %s", name, strings.Join(append(chain, name), " -> "))
+		}
+		chain = append(chain, name)
+
+		i := slices.IndexFunc(c.Templates, func(t templateConfig) bool { return t.Name == name })
+		if i < 0 {
+			return "", fmt.Errorf("template not found among defined templates: %s", name)
+		}
+		directives = append(directives, c.Templates[i].Directives)
+		name = c.Templates[i].Extends
+	}
+
+	// the extended templates come first
+	slices.Reverse(directives)
+	return joinDirectives(directives...), nil
+}
+
+// joinDirectives concatenates the directives, separated by line breaks.
+func joinDirectives(directives ...string) string {
+	var sb strings.Builder
+	for _, d := range directives {
+		if d == "" {
+			continue
+		}
+		if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(d)
+	}
+	return sb.String()
+}
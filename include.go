@@ -0,0 +1,79 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeApplications appends the applications defined by the *.yaml and
+// *.yml files in the include_dir, in the order of their names.
+func (c *config) includeApplications(in *interpolator) error {
+	if c.IncludeDir == "" {
+		return nil
+	}
+	files, err := includeFiles(resolveConfigPath(c.IncludeDir))
+	if err != nil {
+		return fmt.Errorf("include_dir: %v", err)
+	}
+	for _, file := range files {
+		var fragment config
+		root, err := decodeConfigFile(file, in, &fragment)
+		if errors.Is(err, io.EOF) {
+			// empty file
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if err := checkFragmentKeys(root); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+
+		c.positions.readPositions(file, root)
+		c.Applications = append(c.Applications, fragment.Applications...)
+	}
+	return nil
+}
+
+// includeFiles returns the YAML files in dir sorted by name.
+func includeFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	// ReadDir sorts the entries by name
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml":
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+// checkFragmentKeys makes sure an included file only defines applications,
+// the global settings are reserved to the main config file.
+func checkFragmentKeys(root *yaml.Node) error {
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	mapping := root.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if key := mapping.Content[i]; key.Value != "applications" {
+			return fmt.Errorf("line %d: %s cannot be set in an included file, only applications", key.Line, key.Value)
+		}
+	}
+	return nil
+}
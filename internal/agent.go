@@ -3,12 +3,14 @@ package internal
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
 	"github.com/dropmorepackets/haproxy-go/spop"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
 
@@ -16,99 +18,314 @@ type Agent struct {
 	Context            context.Context
 	DefaultApplication *Application
 	Applications       map[string]*Application
+	Routes             []Route
 	Logger             zerolog.Logger
+	// OnError is the fail action for messages that cannot be mapped to
+	// an application. Applications use their own AppConfig.OnError.
+	OnError FailAction
 
-	mtx sync.RWMutex
+	mtx       sync.RWMutex
+	listeners map[net.Listener]struct{}
+	inFlight  atomic.Int64
+	// generations holds the applications replaced by reloads until their
+	// cached transactions are completed or expired.
+	generations []*generation
+	releaseOnce sync.Once
 }
 
+// Serve accepts SPOP connections on l until it is closed. It returns nil
+// if the listener was closed by CloseListener or Shutdown.
 func (a *Agent) Serve(l net.Listener) error {
+	a.mtx.Lock()
+	if a.listeners == nil {
+		a.listeners = make(map[net.Listener]struct{})
+	}
+	a.listeners[l] = struct{}{}
+	a.mtx.Unlock()
+
 	agent := spop.Agent{
 		Handler:     a,
 		BaseContext: a.Context,
 	}
 
-	return agent.Serve(l)
+	err := agent.Serve(l)
+
+	a.mtx.Lock()
+	_, serving := a.listeners[l]
+	delete(a.listeners, l)
+	a.mtx.Unlock()
+	if !serving && errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// CloseListener stops accepting connections on l. Connections accepted
+// before are kept open until HAProxy closes them.
+func (a *Agent) CloseListener(l net.Listener) error {
+	a.mtx.Lock()
+	delete(a.listeners, l)
+	a.mtx.Unlock()
+	return l.Close()
 }
 
-func (a *Agent) ReplaceApplications(newApps map[string]*Application) {
+// Shutdown stops accepting new connections and waits for the messages in
+// flight on existing connections until ctx is done. Afterward, all cached
+// transactions are closed, which runs the logging phase for them. The
+// returned error reports if the grace period was exceeded, the cached
+// transactions are closed nonetheless.
+func (a *Agent) Shutdown(ctx context.Context) error {
 	a.mtx.Lock()
+	listeners := a.listeners
+	a.listeners = nil
+	a.mtx.Unlock()
+	for l := range listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			a.Logger.Warn().Err(err).Str("addr", l.Addr().String()).Msg("failed closing listener")
+		}
+	}
+
+	err := a.waitInFlight(ctx)
+	if err != nil {
+		a.Logger.Warn().Int64("in_flight", a.inFlight.Load()).Msg("grace period exceeded, closing transactions")
+	}
+
+	a.DrainDetectOnly()
+	for _, app := range a.applications() {
+		app.Close()
+	}
+	a.releaseGenerations(true)
+
+	return err
+}
+
+func (a *Agent) waitInFlight(ctx context.Context) error {
+	const pollInterval = 10 * time.Millisecond
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for a.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// ReplaceApplications swaps the current applications. Replaced applications
+// are retired into a generation which is closed once it is not used anymore.
+func (a *Agent) ReplaceApplications(newApps map[string]*Application, newDefault *Application) {
+	a.mtx.Lock()
+	oldApps, oldDefault := a.Applications, a.DefaultApplication
 	a.Applications = newApps
+	a.DefaultApplication = newDefault
+	a.retire(oldApps, oldDefault)
+	a.mtx.Unlock()
+}
+
+// CurrentApplications returns a copy of the applications by name.
+func (a *Agent) CurrentApplications() map[string]*Application {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	apps := make(map[string]*Application, len(a.Applications))
+	for name, app := range a.Applications {
+		apps[name] = app
+	}
+	return apps
+}
+
+func (a *Agent) ReplaceRoutes(newRoutes []Route) {
+	a.mtx.Lock()
+	a.Routes = newRoutes
+	a.mtx.Unlock()
+}
+
+func (a *Agent) ReplaceOnError(action FailAction) {
+	a.mtx.Lock()
+	a.OnError = action
 	a.mtx.Unlock()
 }
 
 // DrainDetectOnly blocks until all in-flight detect-only evaluations
 // complete across all current applications.
 func (a *Agent) DrainDetectOnly() {
+	for _, app := range a.applications() {
+		app.DrainDetectOnly()
+	}
+}
+
+// applications returns all current applications without duplicates.
+func (a *Agent) applications() []*Application {
 	a.mtx.RLock()
 	defer a.mtx.RUnlock()
 	seen := make(map[*Application]struct{}, len(a.Applications)+1)
+	apps := make([]*Application, 0, len(a.Applications)+1)
 	for _, app := range a.Applications {
 		if _, ok := seen[app]; ok {
 			continue
 		}
 		seen[app] = struct{}{}
-		app.DrainDetectOnly()
+		apps = append(apps, app)
 	}
-	// DefaultApplication is expected to be in Applications, but drain
+	// DefaultApplication is expected to be in Applications, but include
 	// it explicitly in case the invariant changes in the future.
 	if a.DefaultApplication != nil {
 		if _, ok := seen[a.DefaultApplication]; !ok {
-			a.DefaultApplication.DrainDetectOnly()
+			apps = append(apps, a.DefaultApplication)
 		}
 	}
+	return apps
 }
 
 func (a *Agent) HandleSPOE(ctx context.Context, writer *encoding.ActionWriter, message *encoding.Message) {
-	timer := prometheus.NewTimer(handleSPOEDuration)
-	defer timer.ObserveDuration()
+	start := time.Now()
+	a.inFlight.Add(1)
+	defer a.inFlight.Add(-1)
 
 	const (
-		messageCorazaRequest  = "coraza-req"
-		messageCorazaResponse = "coraza-res"
+		messageCorazaRequest        = "coraza-req"
+		messageCorazaRequestHeaders = "coraza-req-headers"
+		messageCorazaRequestBody    = "coraza-req-body"
+		messageCorazaResponse       = "coraza-res"
 	)
 
-	var messageHandler func(*Application, context.Context, *encoding.ActionWriter, *encoding.Message) error
-	switch name := string(message.NameBytes()); name {
+	messageName := string(message.NameBytes())
+	var messageHandler func(*Application, context.Context, *encoding.ActionWriter, kvReader) error
+	switch messageName {
 	case messageCorazaRequest:
 		messageHandler = (*Application).HandleRequest
+	case messageCorazaRequestHeaders:
+		messageHandler = (*Application).HandleRequestHeaders
+	case messageCorazaRequestBody:
+		messageHandler = (*Application).HandleRequestBody
 	case messageCorazaResponse:
 		messageHandler = (*Application).HandleResponse
 	default:
-		a.Logger.Debug().Str("message", name).Msg("unknown spoe message")
+		a.Logger.Debug().Str("message", messageName).Msg("unknown spoe message")
 		return
 	}
 
-	k := encoding.AcquireKVEntry()
-	defer encoding.ReleaseKVEntry(k)
-	if !message.KV.Next(k) {
-		a.Logger.Panic().Msg("failed reading kv entry")
-		return
+	var (
+		appLabel string
+		outcome  = outcomePass
+	)
+	defer func() {
+		observeMessage(appLabel, messageName, outcome, time.Since(start))
+	}()
+
+	// The app argument may be at any position of the message. Entries read
+	// before it are buffered and replayed to the message handler afterward.
+	replay := &replayKV{next: message.KV}
+	defer replay.release()
+
+	var appName string
+	for {
+		k := encoding.AcquireKVEntry()
+		if !message.KV.Next(k) {
+			encoding.ReleaseKVEntry(k)
+			break
+		}
+		if k.NameEquals("app") {
+			appName = string(k.ValueBytes())
+			encoding.ReleaseKVEntry(k)
+			break
+		}
+		replay.entries = append(replay.entries, k)
+	}
+
+	// Messages continuing a cached transaction may belong to an
+	// application generation replaced by a reload.
+	continuation := messageName == messageCorazaRequestBody || messageName == messageCorazaResponse
+
+	var txID string
+	if continuation {
+		// Read ahead to find the transaction id.
+		replay.bufferAll()
+		for _, k := range replay.entries {
+			if k.NameEquals("id") {
+				txID = string(k.ValueBytes())
+			}
+		}
+	}
+
+	if appName == "" && !continuation {
+		// HAProxy did not tell us the app, so we have to read ahead
+		// to find the host and port for routing.
+		replay.bufferAll()
+
+		var route routeInfo
+		for _, k := range replay.entries {
+			route.collect(k)
+		}
+
+		a.mtx.RLock()
+		routes := a.Routes
+		a.mtx.RUnlock()
+		host := route.host()
+		if name, ok := resolveRoute(routes, host, route.port); ok {
+			appName = name
+			a.Logger.Debug().Str("app", appName).Str("host", host).Msg("resolved app from routes")
+			// Let HAProxy know about the routed app, so the response
+			// message can send it back to us.
+			_ = writer.SetString(encoding.VarScopeTransaction, "app", appName)
+		}
 	}
 
-	appName := string(k.ValueBytes())
-	if !k.NameEquals("app") {
-		// Without knowing the app, we cannot continue. We could fall back to a default application,
-		// but all following code would have to support that as we now already read one of the kv entries.
-		a.Logger.Panic().Str("expected", "app").Str("got", string(k.NameBytes())).Msg("unexpected kv entry")
+	if err := message.KV.Error(); err != nil {
+		a.mtx.RLock()
+		onError := a.OnError
+		a.mtx.RUnlock()
+		reason := a.fail(writer, onError, errReadingKV(err))
+		errorsTotal.WithLabelValues(appLabel, messageName, string(reason)).Inc()
+		outcome = outcomeError
 		return
 	}
 
 	a.mtx.RLock()
 	app := a.Applications[appName]
-	a.mtx.RUnlock()
-	if app == nil && a.DefaultApplication != nil {
-		// If we cannot resolve the app but the default app is configured,
-		// we use the latter to process the request.
+	// If we cannot resolve the app or HAProxy did not send one but the
+	// default app is configured, we use the latter to process the request.
+	fallback := app == nil && a.DefaultApplication != nil
+	if fallback {
 		app = a.DefaultApplication
+	}
+	var crossGeneration bool
+	if txID != "" && (app == nil || !app.hasTransaction(txID)) {
+		// The transaction was created before a reload.
+		if owner := a.retiredOwner(txID); owner != nil {
+			app, fallback, crossGeneration = owner, false, true
+		}
+	}
+	if app != nil {
+		// Keep the app from being closed by a reload while in use.
+		app.acquire()
+	}
+	onError := a.OnError
+	a.mtx.RUnlock()
+	if fallback {
+		defaultApplicationFallbacks.WithLabelValues(messageName).Inc()
 		a.Logger.Debug().Str("app", appName).Msg("app not found, using default app")
 	}
+	if crossGeneration {
+		crossGenerationLookups.WithLabelValues(app.Name, messageName).Inc()
+		a.Logger.Debug().Str("app", app.Name).Str("tx", txID).Msg("transaction found in retired generation")
+	}
 	if app == nil {
 		// If we cannot resolve the app, we fail as this is an invalid configuration.
-		a.Logger.Panic().Str("app", appName).Msg("app not found")
+		reason := a.fail(writer, onError, ErrFailed{Reason: ErrorReasonAppNotFound, Err: fmt.Errorf("app not found: %q", appName)})
+		errorsTotal.WithLabelValues(appLabel, messageName, string(reason)).Inc()
+		outcome = outcomeError
 		return
 	}
+	defer app.release()
+	appLabel = app.Name
 
-	err := messageHandler(app, ctx, writer, message)
+	err := messageHandler(app, ctx, writer, replay)
+	if kvErr := message.KV.Error(); err == nil && kvErr != nil {
+		// The handler stopped at a malformed entry.
+		err = errReadingKV(kvErr)
+	}
 	if err == nil {
 		return
 	}
@@ -120,10 +337,39 @@ func (a *Agent) HandleSPOE(ctx context.Context, writer *encoding.ActionWriter, m
 		_ = writer.SetString(encoding.VarScopeTransaction, "data", interruption.Interruption.Data)
 		_ = writer.SetInt64(encoding.VarScopeTransaction, "ruleid", int64(interruption.Interruption.RuleID))
 
+		interruptionsTotal.WithLabelValues(appLabel, messageName, interruption.Interruption.Action).Inc()
+		outcome = outcomeInterrupted
 		a.Logger.Debug().Err(err).Msg("sending interruption")
 		return
 	}
 
-	// If the error is not an ErrInterrupted, we panic to let the spop stream fail.
-	a.Logger.Panic().Err(err).Msg("Error handling request")
+	reason := a.fail(writer, app.OnError, err)
+	errorsTotal.WithLabelValues(appLabel, messageName, string(reason)).Inc()
+	outcome = outcomeError
+}
+
+// fail exports the reason of a failed message and the configured fail
+// action to HAProxy. Unlike a panic, this keeps the SPOP stream and all
+// other frames on it alive.
+func (a *Agent) fail(writer *encoding.ActionWriter, action FailAction, err error) ErrorReason {
+	var failed ErrFailed
+	if !errors.As(err, &failed) {
+		failed = ErrFailed{Reason: ErrorReasonInternal, Err: err}
+	}
+	if action == "" {
+		action = FailActionDeny
+	}
+
+	_ = writer.SetString(encoding.VarScopeTransaction, "error_reason", string(failed.Reason))
+	_ = writer.SetString(encoding.VarScopeTransaction, "fail_action", string(action))
+
+	a.Logger.Warn().Err(err).
+		Str("reason", string(failed.Reason)).
+		Str("fail_action", string(action)).
+		Msg("failed handling message")
+	return failed.Reason
+}
+
+func errReadingKV(err error) error {
+	return ErrFailed{Reason: ErrorReasonInternal, Err: fmt.Errorf("reading kv entry: %v", err)}
 }
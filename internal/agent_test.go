@@ -0,0 +1,860 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+// buildMessage encodes a single SPOE message with the KV entries written
+// by fn, the same way HAProxy sends it in a NOTIFY frame.
+func buildMessage(t *testing.T, name string, fn func(kw *encoding.KVWriter) error) *encoding.Message {
+	t.Helper()
+
+	kvBuf := make([]byte, 16384)
+	kw := encoding.NewKVWriter(kvBuf, 0)
+	if err := fn(kw); err != nil {
+		t.Fatal(err)
+	}
+	return buildRawMessage(t, name, kvBuf[:kw.Off()])
+}
+
+// buildRawMessage builds a SPOE message from encoded KV entries.
+func buildRawMessage(t *testing.T, name string, kv []byte) *encoding.Message {
+	t.Helper()
+
+	buf := make([]byte, 0, len(name)+len(kv)+16)
+	var lenBuf [10]byte
+	n, err := encoding.PutVarint(lenBuf[:], uint64(len(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, lenBuf[:n]...)
+	buf = append(buf, name...)
+	// The entry count is only used by HAProxy, the scanner reads until
+	// the buffer is exhausted.
+	buf = append(buf, 0)
+	buf = append(buf, kv...)
+
+	s := encoding.NewMessageScanner(buf)
+	msg := &encoding.Message{}
+	if !s.Next(msg) {
+		t.Fatalf("failed decoding message: %v", s.Error())
+	}
+	return msg
+}
+
+// actionVars decodes the set-var actions written to aw.
+func actionVars(t *testing.T, aw *encoding.ActionWriter) map[string]any {
+	t.Helper()
+
+	vars := make(map[string]any)
+	buf := aw.Bytes()
+	for len(buf) > 0 {
+		// action type, number of args and var scope
+		buf = buf[3:]
+		s := encoding.NewKVScanner(buf, 1)
+		k := encoding.AcquireKVEntry()
+		if !s.Next(k) {
+			t.Fatalf("failed decoding action: %v", s.Error())
+		}
+		vars[string(k.NameBytes())] = k.Value()
+		encoding.ReleaseKVEntry(k)
+		buf = buf[len(buf)-s.RemainingBuf():]
+	}
+	return vars
+}
+
+const testDirectives = `
+SecRuleEngine On
+SecRequestBodyAccess On
+SecRule REQUEST_URI "@contains /blocked" "id:1,phase:1,deny,status:403"
+SecRule REQUEST_BODY "@contains evilpayload" "id:2,phase:2,deny,status:403"
+`
+
+func newTestAgent(t *testing.T, names ...string) *Agent {
+	t.Helper()
+	return newTestAgentWith(t, testDirectives, nil, names...)
+}
+
+// newTestAgentWith creates an agent with an application per name, loading
+// the directives. configure, if not nil, adjusts the config of each
+// application before it is created.
+func newTestAgentWith(t *testing.T, directives string, configure func(*AppConfig), names ...string) *Agent {
+	t.Helper()
+
+	apps := make(map[string]*Application, len(names))
+	for _, name := range names {
+		cfg := AppConfig{
+			Name:           name,
+			Directives:     directives,
+			ResponseCheck:  true,
+			Logger:         zerolog.Nop(),
+			TransactionTTL: 10 * time.Second,
+		}
+		if configure != nil {
+			configure(&cfg)
+		}
+		app, err := cfg.NewApplication()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(app.cache.stop)
+		apps[name] = app
+	}
+
+	return &Agent{
+		Context:      context.Background(),
+		Applications: apps,
+		Logger:       zerolog.Nop(),
+	}
+}
+
+func TestAgent_RoutesWithoutApp(t *testing.T) {
+	a := newTestAgent(t, "api", "shop")
+	a.Routes = []Route{
+		{Host: "api.example.com", Application: "api"},
+		{Host: "*.shop.example.com", Application: "shop"},
+	}
+
+	tests := []struct {
+		name    string
+		kv      func(kw *encoding.KVWriter) error
+		wantApp string
+	}{
+		{
+			name: "host header",
+			kv: func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", ""); err != nil {
+					return err
+				}
+				return kw.SetString("headers", "host: api.example.com\r\naccept: */*\r\n")
+			},
+			wantApp: "api",
+		},
+		{
+			name: "binary host header",
+			kv: func(kw *encoding.KVWriter) error {
+				return kw.SetBinary("headers", binaryHeaders(t, "Host", "x.shop.example.com"))
+			},
+			wantApp: "shop",
+		},
+		{
+			name: "sni",
+			kv: func(kw *encoding.KVWriter) error {
+				if err := kw.SetNull("app"); err != nil {
+					return err
+				}
+				return kw.SetString("sni", "eu.shop.example.com")
+			},
+			wantApp: "shop",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := buildMessage(t, "coraza-req", tt.kv)
+			aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+			a.HandleSPOE(context.Background(), aw, msg)
+
+			vars := actionVars(t, aw)
+			if got := vars["app"]; got != tt.wantApp {
+				t.Errorf("expected app %q, got %v", tt.wantApp, got)
+			}
+			id, _ := vars["id"].(string)
+			if _, ok := a.Applications[tt.wantApp].cache.Get(id); !ok {
+				t.Errorf("expected transaction %q to be cached by app %q", id, tt.wantApp)
+			}
+		})
+	}
+}
+
+func TestAgent_RoutesIgnoredWithApp(t *testing.T) {
+	a := newTestAgent(t, "api", "shop")
+	a.Routes = []Route{{Host: "api.example.com", Application: "api"}}
+
+	msg := buildMessage(t, "coraza-req", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("app", "shop"); err != nil {
+			return err
+		}
+		return kw.SetString("headers", "host: api.example.com\r\n")
+	})
+	aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+	a.HandleSPOE(context.Background(), aw, msg)
+
+	vars := actionVars(t, aw)
+	if _, ok := vars["app"]; ok {
+		t.Errorf("expected app not to be exported, got %v", vars["app"])
+	}
+	id, _ := vars["id"].(string)
+	if _, ok := a.Applications["shop"].cache.Get(id); !ok {
+		t.Errorf("expected transaction %q to be cached by app %q", id, "shop")
+	}
+}
+
+func TestAgent_AppArgumentOrder(t *testing.T) {
+	a := newTestAgent(t, "default", "other")
+	a.DefaultApplication = a.Applications["default"]
+
+	tests := []struct {
+		name    string
+		kv      func(kw *encoding.KVWriter) error
+		wantApp string
+		blocked bool
+	}{
+		{
+			name: "app after other arguments",
+			kv: func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("method", "GET"); err != nil {
+					return err
+				}
+				if err := kw.SetString("path", "/blocked"); err != nil {
+					return err
+				}
+				if err := kw.SetString("app", "other"); err != nil {
+					return err
+				}
+				return kw.SetString("version", "1.1")
+			},
+			wantApp: "other",
+			blocked: true,
+		},
+		{
+			name: "app missing",
+			kv: func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("method", "GET"); err != nil {
+					return err
+				}
+				return kw.SetString("path", "/")
+			},
+			wantApp: "default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := buildMessage(t, "coraza-req", tt.kv)
+			aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+			a.HandleSPOE(context.Background(), aw, msg)
+
+			vars := actionVars(t, aw)
+			if got := vars["action"] == "deny"; got != tt.blocked {
+				t.Errorf("expected blocked to be %v, got vars %v", tt.blocked, vars)
+			}
+			if tt.blocked {
+				// interrupted transactions are not cached
+				return
+			}
+			id, _ := vars["id"].(string)
+			if _, ok := a.Applications[tt.wantApp].cache.Get(id); !ok {
+				t.Errorf("expected transaction %q to be cached by app %q", id, tt.wantApp)
+			}
+		})
+	}
+}
+
+func TestAgent_FailAction(t *testing.T) {
+	a := newTestAgent(t, "default")
+	a.Applications["default"].OnError = FailActionAllow
+
+	tests := []struct {
+		name       string
+		message    string
+		kv         func(kw *encoding.KVWriter) error
+		wantReason ErrorReason
+		wantAction FailAction
+	}{
+		{
+			name:    "app not found",
+			message: "coraza-req",
+			kv: func(kw *encoding.KVWriter) error {
+				return kw.SetString("app", "unknown")
+			},
+			wantReason: ErrorReasonAppNotFound,
+			wantAction: FailActionDeny,
+		},
+		{
+			name:    "invalid header",
+			message: "coraza-req",
+			kv: func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", "default"); err != nil {
+					return err
+				}
+				return kw.SetString("headers", "no-colon\r\n")
+			},
+			wantReason: ErrorReasonHeaderParse,
+			wantAction: FailActionAllow,
+		},
+		{
+			name:    "transaction not found",
+			message: "coraza-res",
+			kv: func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", "default"); err != nil {
+					return err
+				}
+				return kw.SetString("id", "unknown")
+			},
+			wantReason: ErrorReasonTxNotFound,
+			wantAction: FailActionAllow,
+		},
+		{
+			name:    "invalid id",
+			message: "coraza-req",
+			kv: func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", "default"); err != nil {
+					return err
+				}
+				return kw.SetString("id", "with space")
+			},
+			wantReason: ErrorReasonInvalidID,
+			wantAction: FailActionAllow,
+		},
+		{
+			name:    "invalid address",
+			message: "coraza-req",
+			kv: func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", "default"); err != nil {
+					return err
+				}
+				return kw.SetString("src-ip", "10.0.0.1")
+			},
+			wantReason: ErrorReasonHeaderParse,
+			wantAction: FailActionAllow,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := buildMessage(t, tt.message, tt.kv)
+			aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+			a.HandleSPOE(context.Background(), aw, msg)
+
+			vars := actionVars(t, aw)
+			if got := vars["error_reason"]; got != string(tt.wantReason) {
+				t.Errorf("expected error_reason %q, got %v", tt.wantReason, got)
+			}
+			if got := vars["fail_action"]; got != string(tt.wantAction) {
+				t.Errorf("expected fail_action %q, got %v", tt.wantAction, got)
+			}
+		})
+	}
+}
+
+func TestAgent_MalformedMessage(t *testing.T) {
+	a := newTestAgent(t, "default")
+	a.OnError = FailActionAllow
+	a.Applications["default"].OnError = FailActionDeny
+
+	// entries followed by an entry of an unknown data type
+	malformed := func(fn func(kw *encoding.KVWriter) error) []byte {
+		kvBuf := make([]byte, 1024)
+		kw := encoding.NewKVWriter(kvBuf, 0)
+		if err := fn(kw); err != nil {
+			t.Fatal(err)
+		}
+		return append(kvBuf[:kw.Off()], 1, 'x', 0x0f)
+	}
+
+	tests := []struct {
+		name       string
+		kv         []byte
+		wantAction FailAction
+	}{
+		{
+			// the app is not known yet, so the global action applies
+			name: "before app",
+			kv: malformed(func(kw *encoding.KVWriter) error {
+				return kw.SetString("path", "/")
+			}),
+			wantAction: FailActionAllow,
+		},
+		{
+			name: "after app",
+			kv: malformed(func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", "default"); err != nil {
+					return err
+				}
+				return kw.SetString("path", "/")
+			}),
+			wantAction: FailActionDeny,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := buildRawMessage(t, "coraza-req", tt.kv)
+			aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+			a.HandleSPOE(context.Background(), aw, msg)
+
+			vars := actionVars(t, aw)
+			if got := vars["error_reason"]; got != string(ErrorReasonInternal) {
+				t.Errorf("expected error_reason %q, got %v", ErrorReasonInternal, got)
+			}
+			if got := vars["fail_action"]; got != string(tt.wantAction) {
+				t.Errorf("expected fail_action %q, got %v", tt.wantAction, got)
+			}
+		})
+	}
+}
+
+func TestAgent_Metrics(t *testing.T) {
+	a := newTestAgent(t, "metrics-app")
+	a.DefaultApplication = a.Applications["metrics-app"]
+
+	passed := testutil.ToFloat64(messagesTotal.WithLabelValues("metrics-app", "coraza-req", outcomePass))
+	interrupted := testutil.ToFloat64(interruptionsTotal.WithLabelValues("metrics-app", "coraza-req", "deny"))
+	fallbacks := testutil.ToFloat64(defaultApplicationFallbacks.WithLabelValues("coraza-req"))
+	cached := testutil.ToFloat64(transactionCacheEntries.WithLabelValues("metrics-app"))
+
+	send := func(app, path string) map[string]any {
+		msg := buildMessage(t, "coraza-req", func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("app", app); err != nil {
+				return err
+			}
+			return kw.SetString("path", path)
+		})
+		aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+		a.HandleSPOE(context.Background(), aw, msg)
+		return actionVars(t, aw)
+	}
+
+	send("metrics-app", "/")
+	send("unknown", "/blocked")
+
+	if got := testutil.ToFloat64(messagesTotal.WithLabelValues("metrics-app", "coraza-req", outcomePass)); got != passed+1 {
+		t.Errorf("expected %v passed messages, got %v", passed+1, got)
+	}
+	if got := testutil.ToFloat64(interruptionsTotal.WithLabelValues("metrics-app", "coraza-req", "deny")); got != interrupted+1 {
+		t.Errorf("expected %v interruptions, got %v", interrupted+1, got)
+	}
+	if got := testutil.ToFloat64(defaultApplicationFallbacks.WithLabelValues("coraza-req")); got != fallbacks+1 {
+		t.Errorf("expected %v fallbacks, got %v", fallbacks+1, got)
+	}
+	if got := testutil.ToFloat64(transactionCacheEntries.WithLabelValues("metrics-app")); got != cached+1 {
+		t.Errorf("expected %v cached transactions, got %v", cached+1, got)
+	}
+}
+
+func TestAgent_ChunkedRequestBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		ttl           time.Duration
+		responseCheck bool
+	}{
+		{name: "response check", ttl: 10 * time.Second, responseCheck: true},
+		// the chunks must not expire without a TTL
+		{name: "without ttl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgentWith(t, testDirectives, func(c *AppConfig) {
+				c.TransactionTTL = tt.ttl
+				c.ResponseCheck = tt.responseCheck
+			}, "default")
+			testChunkedRequestBody(t, a)
+		})
+	}
+}
+
+func testChunkedRequestBody(t *testing.T, a *Agent) {
+	send := func(name string, fn func(kw *encoding.KVWriter) error) map[string]any {
+		msg := buildMessage(t, name, func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("app", "default"); err != nil {
+				return err
+			}
+			return fn(kw)
+		})
+		aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+		a.HandleSPOE(context.Background(), aw, msg)
+		return actionVars(t, aw)
+	}
+
+	vars := send("coraza-req", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("method", "POST"); err != nil {
+			return err
+		}
+		if err := kw.SetString("headers", "content-type: application/x-www-form-urlencoded\r\n"); err != nil {
+			return err
+		}
+		if err := kw.SetBinary("body", []byte("some evil")); err != nil {
+			return err
+		}
+		return kw.SetBool("more-body", true)
+	})
+	if vars["action"] != nil {
+		t.Fatalf("expected first chunk not to be interrupted, got %v", vars)
+	}
+	id := vars["id"].(string)
+
+	vars = send("coraza-req-body", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("id", id); err != nil {
+			return err
+		}
+		if err := kw.SetBinary("body", []byte("pay")); err != nil {
+			return err
+		}
+		return kw.SetBool("more-body", true)
+	})
+	if vars["action"] != nil || vars["error_reason"] != nil {
+		t.Fatalf("expected second chunk to pass, got %v", vars)
+	}
+
+	vars = send("coraza-req-body", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("id", id); err != nil {
+			return err
+		}
+		return kw.SetBinary("body", []byte("load"))
+	})
+	if vars["action"] != "deny" {
+		t.Errorf("expected last chunk to be denied, got %v", vars)
+	}
+
+	// The transaction is closed after the interruption.
+	vars = send("coraza-req-body", func(kw *encoding.KVWriter) error {
+		return kw.SetString("id", id)
+	})
+	if vars["error_reason"] != string(ErrorReasonTxNotFound) {
+		t.Errorf("expected error_reason %q, got %v", ErrorReasonTxNotFound, vars)
+	}
+}
+
+func TestAgent_RequestBodyAfterCompletion(t *testing.T) {
+	a := newTestAgent(t, "default")
+
+	send := func(name string, fn func(kw *encoding.KVWriter) error) map[string]any {
+		msg := buildMessage(t, name, func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("app", "default"); err != nil {
+				return err
+			}
+			return fn(kw)
+		})
+		aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+		a.HandleSPOE(context.Background(), aw, msg)
+		return actionVars(t, aw)
+	}
+
+	vars := send("coraza-req", func(kw *encoding.KVWriter) error {
+		return kw.SetString("path", "/")
+	})
+	id := vars["id"].(string)
+
+	// A stray body message must not take the transaction cached for the
+	// response.
+	vars = send("coraza-req-body", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("id", id); err != nil {
+			return err
+		}
+		return kw.SetBinary("body", []byte("late"))
+	})
+	if vars["error_reason"] != string(ErrorReasonInternal) {
+		t.Errorf("expected error_reason %q, got %v", ErrorReasonInternal, vars)
+	}
+
+	vars = send("coraza-res", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("id", id); err != nil {
+			return err
+		}
+		return kw.SetInt32("status", 200)
+	})
+	if vars["error_reason"] != nil {
+		t.Errorf("expected response to find the transaction, got %v", vars)
+	}
+}
+
+func TestAgent_SplitRequestPhases(t *testing.T) {
+	tests := []struct {
+		name          string
+		ttl           time.Duration
+		responseCheck bool
+	}{
+		{name: "response check", ttl: 10 * time.Second, responseCheck: true},
+		// the transaction must wait for the body without a TTL
+		{name: "without ttl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgentWith(t, testDirectives, func(c *AppConfig) {
+				c.TransactionTTL = tt.ttl
+				c.ResponseCheck = tt.responseCheck
+			}, "default")
+			testSplitRequestPhases(t, a)
+		})
+	}
+}
+
+func testSplitRequestPhases(t *testing.T, a *Agent) {
+	send := func(name string, fn func(kw *encoding.KVWriter) error) map[string]any {
+		msg := buildMessage(t, name, func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("app", "default"); err != nil {
+				return err
+			}
+			return fn(kw)
+		})
+		aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+		a.HandleSPOE(context.Background(), aw, msg)
+		return actionVars(t, aw)
+	}
+
+	t.Run("headers interrupt early", func(t *testing.T) {
+		vars := send("coraza-req-headers", func(kw *encoding.KVWriter) error {
+			return kw.SetString("path", "/blocked")
+		})
+		if vars["action"] != "deny" {
+			t.Fatalf("expected headers to be denied, got %v", vars)
+		}
+		if _, ok := a.Applications["default"].cache.Get(vars["id"].(string)); ok {
+			t.Error("expected interrupted transaction not to be cached")
+		}
+	})
+
+	t.Run("body resumes transaction", func(t *testing.T) {
+		vars := send("coraza-req-headers", func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("method", "POST"); err != nil {
+				return err
+			}
+			if err := kw.SetString("path", "/upload"); err != nil {
+				return err
+			}
+			return kw.SetString("headers", "content-type: application/x-www-form-urlencoded\r\n")
+		})
+		if vars["action"] != nil {
+			t.Fatalf("expected headers to pass, got %v", vars)
+		}
+		id := vars["id"].(string)
+
+		vars = send("coraza-req-body", func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("id", id); err != nil {
+				return err
+			}
+			return kw.SetBinary("body", []byte("a=evilpayload"))
+		})
+		if vars["action"] != "deny" {
+			t.Errorf("expected body to be denied, got %v", vars)
+		}
+	})
+}
+
+func TestAgent_Shutdown(t *testing.T) {
+	a := newTestAgent(t, "default")
+	app := a.Applications["default"]
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- a.Serve(l)
+	}()
+
+	closed := make(chan struct{})
+	tx := app.waf.NewTransactionWithID("shutdown-test")
+	app.cache.SetWithExpiration(tx.ID(), &transaction{tx: tx}, time.Minute)
+	// Wrap the eviction callback to observe the flush.
+	evict := app.cache.evictionCallback
+	app.cache.evictionCallback = func(key, value any) {
+		evict(key, value)
+		close(closed)
+	}
+
+	// Wait for Serve to register the listener.
+	deadline := time.Now().Add(time.Second)
+	pollUntil(deadline, time.Millisecond, func() bool {
+		a.mtx.RLock()
+		defer a.mtx.RUnlock()
+		return len(a.listeners) == 1
+	})
+
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected shutdown error: %v", err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected Serve to return nil, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after shutdown")
+	}
+
+	select {
+	case <-closed:
+	default:
+		t.Error("expected cached transaction to be closed")
+	}
+	if _, ok := app.cache.Get(tx.ID()); ok {
+		t.Error("expected cache to be empty")
+	}
+}
+
+func TestAgent_ShutdownGracePeriod(t *testing.T) {
+	a := newTestAgent(t, "default")
+
+	// Simulate a message that never completes.
+	a.inFlight.Add(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := a.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestAgent_Status(t *testing.T) {
+	a := newTestAgent(t, "b", "a")
+	a.DefaultApplication = a.Applications["b"]
+
+	tx := a.Applications["a"].waf.NewTransactionWithID("status-test")
+	a.Applications["a"].cacheTransaction(&transaction{tx: tx})
+
+	status := a.Status()
+	if len(status.Applications) != 2 {
+		t.Fatalf("expected 2 applications, got %d", len(status.Applications))
+	}
+	first, second := status.Applications[0], status.Applications[1]
+	if first.Name != "a" || second.Name != "b" {
+		t.Errorf("expected applications sorted by name, got %q, %q", first.Name, second.Name)
+	}
+	if first.CachedTransactions != 1 || second.CachedTransactions != 0 {
+		t.Errorf("unexpected cached transactions: %d, %d", first.CachedTransactions, second.CachedTransactions)
+	}
+	if first.Default || !second.Default {
+		t.Error("expected only b to be the default application")
+	}
+	if first.DirectivesHash == "" || first.DirectivesHash != second.DirectivesHash {
+		t.Errorf("expected equal directive hashes, got %q, %q", first.DirectivesHash, second.DirectivesHash)
+	}
+	if first.LoadedAt.IsZero() {
+		t.Error("expected load time to be set")
+	}
+	if status.RetiredGenerations != 0 {
+		t.Errorf("expected no retired generations, got %d", status.RetiredGenerations)
+	}
+}
+
+func TestAgent_AnomalyScores(t *testing.T) {
+	const directives = `
+SecRuleEngine On
+SecAction "id:10,phase:1,pass,nolog,setvar:tx.inbound_anomaly_score_threshold=5,setvar:tx.inbound_anomaly_score_pl1=3,setvar:tx.inbound_anomaly_score_pl2=2,setvar:tx.blocking_inbound_anomaly_score=3"
+SecAction "id:11,phase:3,pass,nolog,setvar:tx.outbound_anomaly_score_threshold=4,setvar:tx.outbound_anomaly_score_pl1=4,setvar:tx.blocking_outbound_anomaly_score=4"
+`
+	a := newTestAgentWith(t, directives, nil, "default")
+
+	send := func(name string, fn func(kw *encoding.KVWriter) error) map[string]any {
+		msg := buildMessage(t, name, func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("app", "default"); err != nil {
+				return err
+			}
+			if err := kw.SetBool("exportScores", true); err != nil {
+				return err
+			}
+			return fn(kw)
+		})
+		aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+		a.HandleSPOE(context.Background(), aw, msg)
+		return actionVars(t, aw)
+	}
+
+	vars := send("coraza-req", func(kw *encoding.KVWriter) error {
+		return kw.SetString("method", "GET")
+	})
+	want := map[string]any{
+		"anomaly_score":                   int64(3),
+		"inbound_anomaly_score_pl1":       int64(3),
+		"inbound_anomaly_score_pl2":       int64(2),
+		"inbound_anomaly_score_pl3":       int64(0),
+		"inbound_anomaly_score_pl4":       int64(0),
+		"inbound_anomaly_score_threshold": int64(5),
+	}
+	for name, value := range want {
+		if got := vars[name]; got != value {
+			t.Errorf("request: expected %s %v, got %v", name, value, got)
+		}
+	}
+	if _, ok := vars["outbound_anomaly_score"]; ok {
+		t.Error("request: expected no outbound anomaly score")
+	}
+
+	vars = send("coraza-res", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("id", vars["id"].(string)); err != nil {
+			return err
+		}
+		return kw.SetInt64("status", 200)
+	})
+	want = map[string]any{
+		"anomaly_score":                    int64(3),
+		"outbound_anomaly_score":           int64(4),
+		"outbound_anomaly_score_pl1":       int64(4),
+		"outbound_anomaly_score_pl2":       int64(0),
+		"outbound_anomaly_score_threshold": int64(4),
+	}
+	for name, value := range want {
+		if got := vars[name]; got != value {
+			t.Errorf("response: expected %s %v, got %v", name, value, got)
+		}
+	}
+}
+
+func TestAppConfig_DirectivesFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.conf")
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("base.conf", "Include included.conf\n")
+	writeFile("included.conf", `SecRule REQUEST_URI "@contains /included" "id:1,phase:1,deny,status:403"`+"\n")
+
+	newApp := func() *Application {
+		t.Helper()
+		app, err := AppConfig{
+			Name:            "default",
+			Directives:      "SecRuleEngine On",
+			DirectivesFiles: []string{base},
+			Logger:          zerolog.Nop(),
+			TransactionTTL:  time.Second,
+		}.NewApplication()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(app.cache.stop)
+		return app
+	}
+
+	app := newApp()
+	tx := app.waf.NewTransaction()
+	tx.ProcessURI("/included", "GET", "HTTP/1.1")
+	if it := tx.ProcessRequestHeaders(); it == nil || it.RuleID != 1 {
+		t.Errorf("expected interruption by the included rule, got %v", it)
+	}
+	_ = tx.Close()
+
+	writeFile("base.conf", "Include included.conf\nSecAction \"id:2,phase:1,pass,nolog\"\n")
+	if changed := newApp(); changed.DirectivesHash == app.DirectivesHash {
+		t.Error("expected the directives hash to change with the file")
+	}
+
+	if _, err := (AppConfig{
+		Name:            "default",
+		DirectivesFiles: []string{filepath.Join(dir, "missing.conf")},
+		Logger:          zerolog.Nop(),
+	}).NewApplication(); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
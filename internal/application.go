@@ -1,17 +1,15 @@
 package internal
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"runtime/debug"
 	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	coreruleset "github.com/corazawaf/coraza-coreruleset/v4"
@@ -25,11 +23,37 @@ import (
 )
 
 type AppConfig struct {
+	Name           string
 	Directives     string
 	ResponseCheck  bool
 	Logger         zerolog.Logger
 	TransactionTTL time.Duration
 	LogFormat      string
+	OnError        FailAction
+	// IDGenerator creates ids for requests without an id argument. It
+	// defaults to UUIDv7.
+	IDGenerator IDGenerator
+	// MaxIDLength limits ids sent by HAProxy, it defaults to
+	// DefaultMaxIDLength.
+	MaxIDLength int
+	// TruncatedBody is the policy for bodies shorter than announced, it
+	// defaults to TruncatedBodyInspectPartial.
+	TruncatedBody TruncatedBodyPolicy
+	// InterruptionFields are exported to HAProxy on an interruption.
+	InterruptionFields []InterruptionField
+	// AttackRules selects the rules counted in rules_hit, it defaults to
+	// DefaultAttackRules.
+	AttackRules AttackRules
+	// DirectivesFiles are loaded in order after Directives. Includes in
+	// the files are relative to the including file.
+	DirectivesFiles []string
+	// DirectivesHash is the DirectivesHash of Directives and
+	// DirectivesFiles. It is computed if empty.
+	DirectivesHash string
+	// ConfigHash identifies the configuration the application is built
+	// from. It is set by the caller to decide whether an application can be
+	// kept on reload.
+	ConfigHash string
 }
 
 type Application struct {
@@ -38,6 +62,10 @@ type Application struct {
 	asyncWg sync.WaitGroup
 	asyncMu sync.Mutex
 	draining bool
+	// refs counts the messages currently handled by the application.
+	refs atomic.Int64
+	// loadedAt describes the application in Status.
+	loadedAt time.Time
 
 	AppConfig
 }
@@ -45,6 +73,19 @@ type Application struct {
 type transaction struct {
 	tx types.Transaction
 	m  sync.Mutex
+	// requestBodyPending is set while the request body is sent in
+	// multiple coraza-req-body messages.
+	requestBodyPending bool
+	// request holds what later messages need to know about the request.
+	request requestInfo
+}
+
+type requestInfo struct {
+	method string
+	// contentLength is the announced body length, -1 if unknown.
+	contentLength int64
+	// bodyLength counts the body bytes received so far.
+	bodyLength int64
 }
 
 type applicationRequest struct {
@@ -58,11 +99,29 @@ type applicationRequest struct {
 	Query         []byte
 	Version       string
 	Headers       []byte
+	HeadersFormat HeadersFormat
 	Body          []byte
+	BodySent      bool
+	BodyComplete  *bool
+	MoreBody      bool
 	ExportRuleIDs bool
+	ExportScores  bool
+	// ExportCategories exports the matched CRS attack categories.
+	ExportCategories bool
+}
+
+func (a *Application) HandleRequest(ctx context.Context, writer *encoding.ActionWriter, message kvReader) error {
+	return a.handleRequest(ctx, writer, message, false)
+}
+
+// HandleRequestHeaders evaluates the request up to the request headers
+// phase. The transaction is cached and continued by HandleRequestBody,
+// which allows HAProxy to send the headers before buffering the body.
+func (a *Application) HandleRequestHeaders(ctx context.Context, writer *encoding.ActionWriter, message kvReader) error {
+	return a.handleRequest(ctx, writer, message, true)
 }
 
-func (a *Application) HandleRequest(ctx context.Context, writer *encoding.ActionWriter, message *encoding.Message) (err error) {
+func (a *Application) handleRequest(ctx context.Context, writer *encoding.ActionWriter, message kvReader, headersOnly bool) (err error) {
 	k := encoding.AcquireKVEntry()
 	// run defer via anonymous function to not directly evaluate the arguments.
 	defer func() {
@@ -70,14 +129,18 @@ func (a *Application) HandleRequest(ctx context.Context, writer *encoding.Action
 	}()
 
 	var req applicationRequest
-	for message.KV.Next(k) {
+	for message.Next(k) {
 		switch name := string(k.NameBytes()); name {
 		case "src-ip":
-			req.SrcIp = k.ValueAddr()
+			if req.SrcIp, err = kvAddr(k); err != nil {
+				return ErrFailed{Reason: ErrorReasonHeaderParse, Err: err}
+			}
 		case "src-port":
 			req.SrcPort = k.ValueInt()
 		case "dst-ip":
-			req.DstIp = k.ValueAddr()
+			if req.DstIp, err = kvAddr(k); err != nil {
+				return ErrFailed{Reason: ErrorReasonHeaderParse, Err: err}
+			}
 		case "dst-port":
 			req.DstPort = k.ValueInt()
 		case "method":
@@ -127,32 +190,63 @@ func (a *Application) HandleRequest(ctx context.Context, writer *encoding.Action
 			}()
 
 			req.Body = currK.ValueBytes()
+			req.BodySent = true
 			// acquire a new kv entry to continue reading other message values.
 			k = encoding.AcquireKVEntry()
+		case "body-complete":
+			complete := k.ValueBool()
+			req.BodyComplete = &complete
 		case "id":
 			req.ID = string(k.ValueBytes())
+		case "more-body":
+			req.MoreBody = k.ValueBool()
+		case "headers-format":
+			req.HeadersFormat = HeadersFormat(k.ValueBytes())
 		case "exportRuleIDs":
 			req.ExportRuleIDs = k.ValueBool()
+		case "exportScores":
+			req.ExportScores = k.ValueBool()
+		case "exportCategories":
+			req.ExportCategories = k.ValueBool()
+		case "host", "sni":
+			// only used by the agent for routing
 		default:
 			a.Logger.Debug().Str("name", name).Msg("unknown kv entry")
 		}
 	}
 
+	if headersOnly {
+		// The body follows in coraza-req-body messages.
+		req.Body, req.MoreBody = nil, true
+	}
+
+	if req.HeadersFormat, err = parseHeadersFormat(string(req.HeadersFormat)); err != nil {
+		return ErrFailed{Reason: ErrorReasonHeaderParse, Err: err}
+	}
+
 	// Check if we have received an id from haproxy
 	if len(req.ID) == 0 {
-		const idLength = 16
-		var sb strings.Builder
-		sb.Grow(idLength)
-		for i := 0; i < idLength; i++ {
-			sb.WriteRune(rune('A' + rand.Intn(26)))
+		req.ID = a.IDGenerator.NewID()
+	} else {
+		if err := validateID(req.ID, a.MaxIDLength); err != nil {
+			return ErrFailed{Reason: ErrorReasonInvalidID, Err: err}
+		}
+		// A reused id would make later messages continue the wrong
+		// transaction.
+		if a.hasTransaction(req.ID) {
+			return ErrFailed{Reason: ErrorReasonInvalidID, Err: fmt.Errorf("duplicate transaction id: %s", req.ID)}
 		}
-		req.ID = sb.String()
 	}
 
 	tx := a.waf.NewTransactionWithID(req.ID)
+	info := requestInfo{
+		method:        req.Method,
+		contentLength: -1,
+		bodyLength:    int64(len(req.Body)),
+	}
 	defer func() {
-		if err == nil && a.ResponseCheck {
-			a.cache.SetWithExpiration(tx.ID(), &transaction{tx: tx}, a.TransactionTTL)
+		if err == nil && (req.MoreBody || a.ResponseCheck) {
+			a.cacheTransaction(&transaction{tx: tx, requestBodyPending: req.MoreBody, request: info})
 			return
 		}
 
@@ -162,7 +256,10 @@ func (a *Application) HandleRequest(ctx context.Context, writer *encoding.Action
 		}
 	}()
 
-	defer exportWAFMetrics(writer, tx, req.ExportRuleIDs)
+	defer a.exportWAFMetrics(writer, tx, directionRequest, req.ExportRuleIDs, req.ExportScores, req.ExportCategories)
+	defer func() {
+		a.exportInterruptionFields(writer, tx, err)
+	}()
 
 	if err := writer.SetString(encoding.VarScopeTransaction, "id", tx.ID()); err != nil {
 		return err
@@ -186,21 +283,47 @@ func (a *Application) HandleRequest(ctx context.Context, writer *encoding.Action
 		tx.ProcessURI(url.String(), req.Method, "HTTP/"+req.Version)
 	}
 
-	if err := readHeaders(req.Headers, tx.AddRequestHeader, tx.SetServerName); err != nil {
-		return fmt.Errorf("reading headers: %v", err)
+	addHeader := func(key, value string) {
+		tx.AddRequestHeader(key, value)
+		if n := parseContentLength(key, value); n >= 0 {
+			info.contentLength = n
+		}
+	}
+	if err := readHeaders(req.Headers, req.HeadersFormat, addHeader, tx.SetServerName); err != nil {
+		return ErrFailed{Reason: ErrorReasonHeaderParse, Err: fmt.Errorf("reading headers: %v", err)}
 	}
 
 	if it := tx.ProcessRequestHeaders(); it != nil {
 		return ErrInterrupted{it}
 	}
 
-	switch it, _, err := tx.WriteRequestBody(req.Body); {
+	if !req.MoreBody && (req.BodySent || req.BodyComplete != nil) && bodyTruncated(req.BodyComplete, info.bodyLength, info.contentLength) {
+		skipBody, err := a.handleTruncatedBody(tx, directionRequest)
+		if err != nil {
+			return err
+		}
+		if skipBody {
+			req.Body = nil
+		}
+	}
+
+	return processRequestBody(tx, req.Body, req.MoreBody)
+}
+
+// processRequestBody writes a body chunk to the transaction and evaluates
+// the request body phase once the last chunk was written.
+func processRequestBody(tx types.Transaction, body []byte, moreBody bool) error {
+	switch it, _, err := tx.WriteRequestBody(body); {
 	case err != nil:
-		return err
+		return ErrFailed{Reason: ErrorReasonBodyWrite, Err: err}
 	case it != nil:
 		return ErrInterrupted{it}
 	}
 
+	if moreBody {
+		return nil
+	}
+
 	switch it, err := tx.ProcessRequestBody(); {
 	case err != nil:
 		return err
@@ -211,29 +334,153 @@ func (a *Application) HandleRequest(ctx context.Context, writer *encoding.Action
 	return nil
 }
 
-func readHeaders(headers []byte, hdrCallback func(key string, value string), hostCallback func(value string)) error {
-	s := bufio.NewScanner(bytes.NewReader(headers))
-	for s.Scan() {
-		line := bytes.TrimSpace(s.Bytes())
-		if len(line) == 0 {
-			continue
+type applicationRequestBody struct {
+	ID            string
+	Body          []byte
+	BodyComplete  *bool
+	MoreBody      bool
+	ExportRuleIDs bool
+	ExportScores  bool
+	// ExportCategories exports the matched CRS attack categories.
+	ExportCategories bool
+}
+
+// HandleRequestBody continues a transaction started by HandleRequest with
+// more-body set, with the next chunk of the request body.
+func (a *Application) HandleRequestBody(ctx context.Context, writer *encoding.ActionWriter, message kvReader) (err error) {
+	k := encoding.AcquireKVEntry()
+	defer func() {
+		encoding.ReleaseKVEntry(k)
+	}()
+
+	var req applicationRequestBody
+	// borrowed tracks KV entries whose byte slices are referenced by req.
+	var borrowed []*encoding.KVEntry
+	defer func() {
+		for _, entry := range borrowed {
+			encoding.ReleaseKVEntry(entry)
+		}
+	}()
+	for message.Next(k) {
+		switch name := string(k.NameBytes()); name {
+		case "id":
+			req.ID = string(k.ValueBytes())
+		case "body":
+			currK := k
+			borrowed = append(borrowed, currK)
+			req.Body = currK.ValueBytes()
+			k = encoding.AcquireKVEntry()
+		case "body-complete":
+			complete := k.ValueBool()
+			req.BodyComplete = &complete
+		case "more-body":
+			req.MoreBody = k.ValueBool()
+		case "exportRuleIDs":
+			req.ExportRuleIDs = k.ValueBool()
+		case "exportScores":
+			req.ExportScores = k.ValueBool()
+		case "exportCategories":
+			req.ExportCategories = k.ValueBool()
+		default:
+			a.Logger.Debug().Str("name", name).Msg("unknown kv entry")
 		}
+	}
 
-		kv := bytes.SplitN(line, []byte(":"), 2)
-		if len(kv) != 2 {
-			return fmt.Errorf("invalid header: %q", s.Text())
+	if req.ID == "" {
+		return ErrFailed{Reason: ErrorReasonTxNotFound, Err: fmt.Errorf("request id is empty")}
+	}
+
+	t, err := a.takeTransaction(req.ID, true)
+	if err != nil {
+		return err
+	}
+	tx := t.tx
+
+	defer func() {
+		if err == nil && (req.MoreBody || a.ResponseCheck) {
+			a.cacheTransaction(&transaction{tx: tx, requestBodyPending: req.MoreBody, request: t.request})
+			return
 		}
 
-		key, value := bytes.TrimSpace(kv[0]), bytes.TrimSpace(kv[1])
+		tx.ProcessLogging()
+		if err := tx.Close(); err != nil {
+			a.Logger.Error().Str("tx", tx.ID()).Err(err).Msg("failed to close transaction")
+		}
+	}()
+
+	defer a.exportWAFMetrics(writer, tx, directionRequest, req.ExportRuleIDs, req.ExportScores, req.ExportCategories)
+	defer func() {
+		a.exportInterruptionFields(writer, tx, err)
+	}()
+
+	if tx.IsRuleEngineOff() {
+		return nil
+	}
 
-		if hostCallback != nil && string(key) == "host" {
-			hostCallback(string(value))
+	t.request.bodyLength += int64(len(req.Body))
+	if !req.MoreBody && bodyTruncated(req.BodyComplete, t.request.bodyLength, t.request.contentLength) {
+		// Chunks written before are inspected regardless of the policy.
+		skipBody, err := a.handleTruncatedBody(tx, directionRequest)
+		if err != nil {
+			return err
 		}
+		if skipBody {
+			req.Body = nil
+		}
+	}
+
+	return processRequestBody(tx, req.Body, req.MoreBody)
+}
+
+// DefaultRequestBodyTTL is how long a transaction waits for the next chunk
+// of the request body if the application has no TransactionTTL.
+const DefaultRequestBodyTTL = 10 * time.Second
+
+// cacheTransaction stores the transaction until it is continued by another
+// message or evicted after the transaction TTL.
+func (a *Application) cacheTransaction(t *transaction) {
+	a.cache.SetWithExpiration(t.tx.ID(), t, a.cacheTTL(t.requestBodyPending))
+	transactionCacheEntries.WithLabelValues(a.Name).Inc()
+}
 
-		hdrCallback(string(key), string(value))
+// cacheTTL returns how long a transaction is cached. Transactions waiting
+// for the request body are cached for at least DefaultRequestBodyTTL if no
+// TransactionTTL is configured, as the TTL is optional without
+// ResponseCheck.
+func (a *Application) cacheTTL(requestBodyPending bool) time.Duration {
+	if requestBodyPending && a.TransactionTTL <= 0 {
+		return DefaultRequestBodyTTL
 	}
+	return a.TransactionTTL
+}
 
-	return nil
+// hasTransaction reports if the transaction is cached by the application.
+func (a *Application) hasTransaction(id string) bool {
+	_, ok := a.cache.Get(id)
+	return ok
+}
+
+// takeTransaction removes the transaction from the cache and locks it, so
+// it cannot be evicted while in use. With requestBody set, only a
+// transaction waiting for the request body is taken, any other is left in
+// the cache.
+func (a *Application) takeTransaction(id string, requestBody bool) (*transaction, error) {
+	cv, ok := a.cache.Get(id)
+	if !ok {
+		return nil, ErrFailed{Reason: ErrorReasonTxNotFound, Err: fmt.Errorf("transaction not found: %s", id)}
+	}
+	t := cv.(*transaction)
+	if requestBody && !t.requestBodyPending {
+		return nil, fmt.Errorf("request body was already processed: %s", id)
+	}
+	if a.cache.Remove(id) {
+		transactionCacheEntries.WithLabelValues(a.Name).Dec()
+	}
+
+	if !t.m.TryLock() {
+		return nil, ErrFailed{Reason: ErrorReasonTxNotFound, Err: fmt.Errorf("transaction is already being deleted: %s", id)}
+	}
+	return t, nil
 }
 
 type applicationResponse struct {
@@ -241,12 +488,18 @@ type applicationResponse struct {
 	Version       string
 	Status        int64
 	Headers       []byte
+	HeadersFormat HeadersFormat
 	Body          []byte
+	BodySent      bool
+	BodyComplete  *bool
 	ExportRuleIDs bool
+	ExportScores  bool
 	DetectOnly    bool
+	// ExportCategories exports the matched CRS attack categories.
+	ExportCategories bool
 }
 
-func (a *Application) HandleResponse(ctx context.Context, writer *encoding.ActionWriter, message *encoding.Message) (err error) {
+func (a *Application) HandleResponse(ctx context.Context, writer *encoding.ActionWriter, message kvReader) (err error) {
 	if !a.ResponseCheck {
 		return fmt.Errorf("got response but response check is disabled")
 	}
@@ -266,7 +519,7 @@ func (a *Application) HandleResponse(ctx context.Context, writer *encoding.Actio
 			encoding.ReleaseKVEntry(entry)
 		}
 	}()
-	for message.KV.Next(k) {
+	for message.Next(k) {
 		switch name := string(k.NameBytes()); name {
 		case "id":
 			res.ID = string(k.ValueBytes())
@@ -283,9 +536,19 @@ func (a *Application) HandleResponse(ctx context.Context, writer *encoding.Actio
 			currK := k
 			borrowed = append(borrowed, currK)
 			res.Body = currK.ValueBytes()
+			res.BodySent = true
 			k = encoding.AcquireKVEntry()
+		case "body-complete":
+			complete := k.ValueBool()
+			res.BodyComplete = &complete
+		case "headers-format":
+			res.HeadersFormat = HeadersFormat(k.ValueBytes())
 		case "exportRuleIDs":
 			res.ExportRuleIDs = k.ValueBool()
+		case "exportScores":
+			res.ExportScores = k.ValueBool()
+		case "exportCategories":
+			res.ExportCategories = k.ValueBool()
 		case "detect-only":
 			res.DetectOnly = k.ValueBool()
 		default:
@@ -294,18 +557,16 @@ func (a *Application) HandleResponse(ctx context.Context, writer *encoding.Actio
 	}
 
 	if res.ID == "" {
-		return fmt.Errorf("response id is empty")
+		return ErrFailed{Reason: ErrorReasonTxNotFound, Err: fmt.Errorf("response id is empty")}
 	}
 
-	cv, ok := a.cache.Get(res.ID)
-	if !ok {
-		return fmt.Errorf("transaction not found: %s", res.ID)
+	if res.HeadersFormat, err = parseHeadersFormat(string(res.HeadersFormat)); err != nil {
+		return ErrFailed{Reason: ErrorReasonHeaderParse, Err: err}
 	}
-	a.cache.Remove(res.ID)
 
-	t := cv.(*transaction)
-	if !t.m.TryLock() {
-		return fmt.Errorf("transaction is already being deleted: %s", res.ID)
+	t, err := a.takeTransaction(res.ID, false)
+	if err != nil {
+		return err
 	}
 	tx := t.tx
 
@@ -314,17 +575,42 @@ func (a *Application) HandleResponse(ctx context.Context, writer *encoding.Actio
 			return nil
 		}
 
-		if err := readHeaders(headers, tx.AddResponseHeader, nil); err != nil {
-			return fmt.Errorf("reading headers: %v", err)
+		if t.requestBodyPending {
+			// The last body chunk never arrived, evaluate what we got.
+			if err := processRequestBody(tx, nil, false); err != nil {
+				return err
+			}
+		}
+
+		contentLength := int64(-1)
+		addHeader := func(key, value string) {
+			tx.AddResponseHeader(key, value)
+			if n := parseContentLength(key, value); n >= 0 {
+				contentLength = n
+			}
+		}
+		if err := readHeaders(headers, res.HeadersFormat, addHeader, nil); err != nil {
+			return ErrFailed{Reason: ErrorReasonHeaderParse, Err: fmt.Errorf("reading headers: %v", err)}
 		}
 
 		if it := tx.ProcessResponseHeaders(int(res.Status), "HTTP/"+res.Version); it != nil {
 			return ErrInterrupted{it}
 		}
 
+		if (res.BodySent || res.BodyComplete != nil) && responseHasBody(t.request.method, res.Status) &&
+			bodyTruncated(res.BodyComplete, int64(len(body)), contentLength) {
+			skipBody, err := a.handleTruncatedBody(tx, directionResponse)
+			if err != nil {
+				return err
+			}
+			if skipBody {
+				body = nil
+			}
+		}
+
 		switch it, _, err := tx.WriteResponseBody(body); {
 		case err != nil:
-			return err
+			return ErrFailed{Reason: ErrorReasonBodyWrite, Err: err}
 		case it != nil:
 			return ErrInterrupted{it}
 		}
@@ -358,6 +644,7 @@ func (a *Application) HandleResponse(ctx context.Context, writer *encoding.Actio
 		}
 		a.asyncWg.Add(1)
 		a.asyncMu.Unlock()
+		detectOnlyInFlight.WithLabelValues(a.Name).Inc()
 
 		headers := make([]byte, len(res.Headers))
 		copy(headers, res.Headers)
@@ -366,6 +653,7 @@ func (a *Application) HandleResponse(ctx context.Context, writer *encoding.Actio
 
 		go func() {
 			defer a.asyncWg.Done()
+			defer detectOnlyInFlight.WithLabelValues(a.Name).Dec()
 			defer func() {
 				if r := recover(); r != nil {
 					a.Logger.Error().
@@ -385,7 +673,10 @@ func (a *Application) HandleResponse(ctx context.Context, writer *encoding.Actio
 	}
 
 	defer closeTx()
-	defer exportWAFMetrics(writer, tx, res.ExportRuleIDs)
+	defer a.exportWAFMetrics(writer, tx, directionResponse, res.ExportRuleIDs, res.ExportScores, res.ExportCategories)
+	defer func() {
+		a.exportInterruptionFields(writer, tx, err)
+	}()
 	return process(res.Headers, res.Body)
 }
 
@@ -398,15 +689,55 @@ func (a *Application) DrainDetectOnly() {
 	a.asyncWg.Wait()
 }
 
+func (a *Application) acquire() {
+	a.refs.Add(1)
+}
+
+func (a *Application) release() {
+	a.refs.Add(-1)
+}
+
+// Close waits for detect-only evaluations, stops the eviction of the
+// transaction cache and closes all cached transactions.
+func (a *Application) Close() {
+	a.DrainDetectOnly()
+	a.cache.stop()
+	a.cache.flush()
+}
+
 func (a AppConfig) NewApplication() (*Application, error) {
+	if a.IDGenerator == nil {
+		a.IDGenerator = uuidV7Generator{}
+	}
+	if a.MaxIDLength <= 0 {
+		a.MaxIDLength = DefaultMaxIDLength
+	}
+	if a.TruncatedBody == "" {
+		a.TruncatedBody = TruncatedBodyInspectPartial
+	}
+	if a.AttackRules.empty() {
+		a.AttackRules = DefaultAttackRules
+	}
+
+	if a.DirectivesHash == "" {
+		hash, err := DirectivesHash(a.Directives, a.DirectivesFiles)
+		if err != nil {
+			return nil, err
+		}
+		a.DirectivesHash = hash
+	}
 	app := Application{
 		AppConfig: a,
+		loadedAt:  time.Now(),
 	}
 
 	config := coraza.NewWAFConfig().
 		WithDirectives(a.Directives).
 		WithErrorCallback(app.logCallback).
 		WithRootFS(mergefs.Merge(coreruleset.FS, io.OSFS))
+	for _, file := range a.DirectivesFiles {
+		config = config.WithDirectivesFromFile(file)
+	}
 
 	waf, err := coraza.NewWAF(config)
 	if err != nil {
@@ -418,6 +749,7 @@ func (a AppConfig) NewApplication() (*Application, error) {
 
 	app.cache = newTTLCache(defaultEvictionInterval, func(key, value any) {
 		// everytime a transaction runs into a timeout it gets closed.
+		transactionCacheEntries.WithLabelValues(a.Name).Dec()
 		t := value.(*transaction)
 		if !t.m.TryLock() {
 			// We lost a race and the transaction is already somewhere in use.
@@ -538,55 +870,60 @@ func (e ErrInterrupted) Is(target error) bool {
 	return e.Interruption == t.Interruption
 }
 
-// The CRS ranges logic is copied from go-ftw (https://github.com/coreruleset/go-ftw).
-func isAttackRule(ruleID int) bool {
-	// Standard CRS Attack Ranges (from go-ftw)
-	isFTWAttack := (ruleID >= 910000 && ruleID < 950000) || (ruleID >= 950000 && ruleID < 960000)
-
-	// Custom Local Attack Ranges (e.g., local hardening rules)
-	isCustomAttack := ruleID >= 190000 && ruleID < 200000
-
-	return isFTWAttack || isCustomAttack
-}
-
-func exportWAFMetrics(writer *encoding.ActionWriter, tx types.Transaction, exportRuleIDs bool) error {
+// exportWAFMetrics exports the rules hit and the CRS anomaly scores. The
+// inbound score is exported as anomaly_score for every message, the outbound
+// score only for responses. exportScores adds the scores per paranoia level
+// and the threshold of the direction, exportCategories the attack categories
+// of the attack rules hit.
+func (a *Application) exportWAFMetrics(writer *encoding.ActionWriter, tx types.Transaction, direction string, exportRuleIDs, exportScores, exportCategories bool) error {
 	matchedRules := tx.MatchedRules()
 	var ids []string
 	if exportRuleIDs {
 		ids = make([]string, 0, len(matchedRules))
 	}
+	var categories []string
 	var count int64
 	for _, mr := range matchedRules {
 		// Ignore rules without a message (silent control flow rules)
 		if mr.Message() == "" {
 			continue
 		}
-		// Only include actual attack rules within the CRS range
-		if !isAttackRule(mr.Rule().ID()) {
+		// Only include actual attack rules, by default within the CRS range
+		if !a.AttackRules.matches(mr.Rule()) {
 			continue
 		}
 
 		if exportRuleIDs {
 			ids = append(ids, strconv.Itoa(mr.Rule().ID()))
 		}
+		if exportCategories {
+			categories = appendAttackCategories(categories, mr.Rule().Tags())
+		}
 		count++
 	}
+	if exportCategories {
+		if err := exportAttackCategories(writer, categories); err != nil {
+			return err
+		}
+	}
 	if err := writer.SetInt64(encoding.VarScopeTransaction, "rules_hit", count); err != nil {
 		return err
 	}
 
-	if txState, ok := tx.(plugintypes.TransactionState); ok {
-		scores := txState.Variables().TX().Get("blocking_inbound_anomaly_score")
-		var score int64
-		if len(scores) != 0 {
-			v, err := strconv.ParseInt(scores[0], 10, 64)
-			if err != nil {
+	if _, ok := tx.(plugintypes.TransactionState); ok {
+		if err := writer.SetInt64(encoding.VarScopeTransaction, "anomaly_score", txInt(tx, "blocking_inbound_anomaly_score")); err != nil {
+			return err
+		}
+		if direction == directionResponse {
+			if err := writer.SetInt64(encoding.VarScopeTransaction, "outbound_anomaly_score", txInt(tx, "blocking_outbound_anomaly_score")); err != nil {
 				return err
 			}
-			score = v
 		}
-		if err := writer.SetInt64(encoding.VarScopeTransaction, "anomaly_score", score); err != nil {
-			return err
+
+		if exportScores {
+			if err := exportAnomalyScores(writer, tx, direction); err != nil {
+				return err
+			}
 		}
 
 		if exportRuleIDs {
@@ -598,3 +935,21 @@ func exportWAFMetrics(writer *encoding.ActionWriter, tx types.Transaction, expor
 
 	return nil
 }
+
+// exportAnomalyScores exports the CRS detection scores per paranoia level
+// and the threshold, e.g. inbound_anomaly_score_pl1 and
+// inbound_anomaly_score_threshold.
+func exportAnomalyScores(writer *encoding.ActionWriter, tx types.Transaction, direction string) error {
+	prefix := "inbound_anomaly_score"
+	if direction == directionResponse {
+		prefix = "outbound_anomaly_score"
+	}
+
+	for pl := 1; pl <= 4; pl++ {
+		name := prefix + "_pl" + strconv.Itoa(pl)
+		if err := writer.SetInt64(encoding.VarScopeTransaction, name, txInt(tx, name)); err != nil {
+			return err
+		}
+	}
+	return writer.SetInt64(encoding.VarScopeTransaction, prefix+"_threshold", txInt(tx, prefix+"_threshold"))
+}
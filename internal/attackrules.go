@@ -0,0 +1,157 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+// AttackRules selects the matched rules which are counted in rules_hit and
+// exported in rule_ids. A rule is selected if its id is listed, is within
+// one of the ranges or if one of its tags matches a tag pattern.
+type AttackRules struct {
+	IDs    []int
+	Ranges []RuleIDRange
+	// Tags are patterns in which "*" matches any sequence of characters,
+	// e.g. attack-*.
+	Tags []string
+}
+
+// RuleIDRange is an inclusive range of rule ids.
+type RuleIDRange struct {
+	From, To int
+}
+
+// DefaultAttackRules are the CRS attack ranges as used by go-ftw
+// (https://github.com/coreruleset/go-ftw) and the range for custom local
+// attack rules, e.g. local hardening rules.
+var DefaultAttackRules = AttackRules{
+	Ranges: []RuleIDRange{
+		{From: 910000, To: 959999},
+		{From: 190000, To: 199999},
+	},
+}
+
+// ParseRuleIDRange parses a range like 100000-100999 or a single id.
+func ParseRuleIDRange(s string) (RuleIDRange, error) {
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		toStr = fromStr
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(fromStr))
+	if err != nil {
+		return RuleIDRange{}, fmt.Errorf("invalid rule id range %q", s)
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(toStr))
+	if err != nil {
+		return RuleIDRange{}, fmt.Errorf("invalid rule id range %q", s)
+	}
+	if from > to {
+		return RuleIDRange{}, fmt.Errorf("invalid rule id range %q: start is greater than end", s)
+	}
+	return RuleIDRange{From: from, To: to}, nil
+}
+
+func (r AttackRules) empty() bool {
+	return len(r.IDs) == 0 && len(r.Ranges) == 0 && len(r.Tags) == 0
+}
+
+func (r AttackRules) matches(rule types.RuleMetadata) bool {
+	id := rule.ID()
+	for _, i := range r.IDs {
+		if id == i {
+			return true
+		}
+	}
+	for _, rng := range r.Ranges {
+		if id >= rng.From && id <= rng.To {
+			return true
+		}
+	}
+	for _, pattern := range r.Tags {
+		for _, tag := range rule.Tags() {
+			if matchTag(pattern, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchTag matches a tag against a pattern in which "*" matches any
+// sequence of characters.
+func matchTag(pattern, tag string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == tag
+	}
+
+	prefix, suffix := parts[0], parts[len(parts)-1]
+	if !strings.HasPrefix(tag, prefix) {
+		return false
+	}
+	tag = tag[len(prefix):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(tag, part)
+		if i < 0 {
+			return false
+		}
+		tag = tag[i+len(part):]
+	}
+	return strings.HasSuffix(tag, suffix)
+}
+
+// attackTagPrefix is the prefix of the CRS tags naming the attack category
+// of a rule, e.g. attack-sqli.
+const attackTagPrefix = "attack-"
+
+// appendAttackCategories appends the attack categories of the tags which are
+// not yet in categories.
+func appendAttackCategories(categories []string, tags []string) []string {
+	for _, tag := range tags {
+		category, ok := strings.CutPrefix(tag, attackTagPrefix)
+		if !ok || category == "" || slices.Contains(categories, category) {
+			continue
+		}
+		categories = append(categories, category)
+	}
+	return categories
+}
+
+// exportAttackCategories exports the categories as a sorted comma separated
+// list in attack_categories and as a boolean variable per category, e.g.
+// cat_sqli.
+func exportAttackCategories(writer *encoding.ActionWriter, categories []string) error {
+	slices.Sort(categories)
+	if err := writer.SetString(encoding.VarScopeTransaction, "attack_categories", strings.Join(categories, ",")); err != nil {
+		return err
+	}
+	for _, category := range categories {
+		if err := writer.SetBool(encoding.VarScopeTransaction, categoryVarName(category), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// categoryVarName returns the variable of a category. HAProxy only allows
+// letters, digits, dots and underscores in variable names, so other
+// characters are replaced, e.g. multipart-header becomes
+// cat_multipart_header.
+func categoryVarName(category string) string {
+	return "cat_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, category)
+}
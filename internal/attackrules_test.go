@@ -0,0 +1,211 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+func TestParseRuleIDRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    RuleIDRange
+		wantErr bool
+	}{
+		{in: "100000-100999", want: RuleIDRange{From: 100000, To: 100999}},
+		{in: "100000 - 100999", want: RuleIDRange{From: 100000, To: 100999}},
+		{in: "942100", want: RuleIDRange{From: 942100, To: 942100}},
+		{in: "100999-100000", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "1-", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRuleIDRange(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMatchTag(t *testing.T) {
+	tests := []struct {
+		pattern, tag string
+		want         bool
+	}{
+		{"attack-sqli", "attack-sqli", true},
+		{"attack-sqli", "attack-xss", false},
+		{"attack-*", "attack-sqli", true},
+		{"attack-*", "paranoia-level/1", false},
+		{"*", "anything", true},
+		{"*/1", "paranoia-level/1", true},
+		{"*-level/*", "paranoia-level/2", true},
+		{"a*a", "a", false},
+	}
+	for _, tt := range tests {
+		if got := matchTag(tt.pattern, tt.tag); got != tt.want {
+			t.Errorf("matchTag(%q, %q) = %v, want %v", tt.pattern, tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestApplication_AttackRules(t *testing.T) {
+	const directives = `
+SecRuleEngine On
+SecRule ARGS:q "@contains attack" "id:942100,phase:1,pass,log,msg:'CRS'"
+SecRule ARGS:q "@contains attack" "id:100001,phase:1,pass,log,msg:'Custom range'"
+SecRule ARGS:q "@contains attack" "id:5,phase:1,pass,log,msg:'Custom tag',tag:attack-custom"
+`
+
+	tests := []struct {
+		name    string
+		rules   AttackRules
+		wantHit int64
+		wantIDs string
+	}{
+		{
+			name:    "default",
+			wantHit: 1,
+			wantIDs: "942100",
+		},
+		{
+			name:    "ranges",
+			rules:   AttackRules{Ranges: []RuleIDRange{{From: 100000, To: 100999}}},
+			wantHit: 1,
+			wantIDs: "100001",
+		},
+		{
+			name:    "ids and tags",
+			rules:   AttackRules{IDs: []int{942100}, Tags: []string{"attack-*"}},
+			wantHit: 2,
+			wantIDs: "942100,5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgentWith(t, directives, func(c *AppConfig) {
+				c.AttackRules = tt.rules
+			}, "default")
+
+			msg := buildMessage(t, "coraza-req", func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", "default"); err != nil {
+					return err
+				}
+				if err := kw.SetBool("exportRuleIDs", true); err != nil {
+					return err
+				}
+				if err := kw.SetString("path", "/search"); err != nil {
+					return err
+				}
+				return kw.SetString("query", "q=attack")
+			})
+			aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+			a.HandleSPOE(context.Background(), aw, msg)
+
+			vars := actionVars(t, aw)
+			if got := vars["rules_hit"]; got != tt.wantHit {
+				t.Errorf("expected rules_hit %d, got %v", tt.wantHit, got)
+			}
+			if got := vars["rule_ids"]; got != tt.wantIDs {
+				t.Errorf("expected rule_ids %q, got %v", tt.wantIDs, got)
+			}
+		})
+	}
+}
+
+func TestCategoryVarName(t *testing.T) {
+	tests := map[string]string{
+		"sqli":             "cat_sqli",
+		"multipart-header": "cat_multipart_header",
+		"reputation-ip":    "cat_reputation_ip",
+	}
+	for category, want := range tests {
+		if got := categoryVarName(category); got != want {
+			t.Errorf("categoryVarName(%q) = %q, want %q", category, got, want)
+		}
+	}
+}
+
+func TestApplication_AttackCategories(t *testing.T) {
+	const directives = `
+SecRuleEngine On
+SecRule ARGS:q "@contains select" "id:942100,phase:1,pass,log,msg:'SQLi',tag:attack-sqli,tag:paranoia-level/1"
+SecRule ARGS:q "@contains script" "id:941100,phase:1,pass,log,msg:'XSS',tag:attack-xss"
+SecRule ARGS:q "@contains script" "id:941110,phase:1,pass,log,msg:'XSS',tag:attack-xss"
+SecRule ARGS:q "@contains select" "id:100,phase:1,pass,log,msg:'Not an attack rule',tag:attack-rce"
+`
+
+	tests := []struct {
+		name   string
+		query  string
+		export bool
+		want   map[string]any
+	}{
+		{
+			name:   "categories",
+			query:  "q=select+script",
+			export: true,
+			want: map[string]any{
+				"attack_categories": "sqli,xss",
+				"cat_sqli":          true,
+				"cat_xss":           true,
+			},
+		},
+		{
+			name:   "no match",
+			query:  "q=hello",
+			export: true,
+			want: map[string]any{
+				"attack_categories": "",
+			},
+		},
+		{
+			name:  "disabled",
+			query: "q=select+script",
+			want:  map[string]any{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgentWith(t, directives, nil, "default")
+
+			msg := buildMessage(t, "coraza-req", func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", "default"); err != nil {
+					return err
+				}
+				if err := kw.SetBool("exportCategories", tt.export); err != nil {
+					return err
+				}
+				if err := kw.SetString("path", "/search"); err != nil {
+					return err
+				}
+				return kw.SetString("query", tt.query)
+			})
+			aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+			a.HandleSPOE(context.Background(), aw, msg)
+
+			vars := actionVars(t, aw)
+			for name, want := range tt.want {
+				if got := vars[name]; got != want {
+					t.Errorf("expected %s %v, got %v", name, want, got)
+				}
+			}
+			for name := range vars {
+				if _, ok := tt.want[name]; !ok && (name == "attack_categories" || strings.HasPrefix(name, "cat_")) {
+					t.Errorf("unexpected variable %s", name)
+				}
+			}
+		})
+	}
+}
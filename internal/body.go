@@ -0,0 +1,106 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// TruncatedBodyPolicy decides how a body is handled which is shorter than
+// announced, usually because it did not fit into HAProxy's buffer.
+type TruncatedBodyPolicy string
+
+const (
+	// TruncatedBodyInspectPartial inspects the part of the body received.
+	TruncatedBodyInspectPartial TruncatedBodyPolicy = "inspect_partial"
+	// TruncatedBodyDeny interrupts the transaction with status 413.
+	TruncatedBodyDeny TruncatedBodyPolicy = "deny"
+	// TruncatedBodySkipBody evaluates the body phase without the body.
+	TruncatedBodySkipBody TruncatedBodyPolicy = "skip_body"
+)
+
+// ParseTruncatedBodyPolicy parses the truncated_body policy. An empty value
+// defaults to TruncatedBodyInspectPartial.
+func ParseTruncatedBodyPolicy(s string) (TruncatedBodyPolicy, error) {
+	switch TruncatedBodyPolicy(s) {
+	case "":
+		return TruncatedBodyInspectPartial, nil
+	case TruncatedBodyInspectPartial, TruncatedBodyDeny, TruncatedBodySkipBody:
+		return TruncatedBodyPolicy(s), nil
+	default:
+		return "", fmt.Errorf("unknown truncated_body policy: %q", s)
+	}
+}
+
+const (
+	directionRequest  = "request"
+	directionResponse = "response"
+)
+
+// bodyTruncated reports if a body of the given length is incomplete. The
+// body-complete argument takes precedence over the comparison with the
+// Content-Length, which is negative if unknown.
+func bodyTruncated(bodyComplete *bool, length, contentLength int64) bool {
+	if bodyComplete != nil {
+		return !*bodyComplete
+	}
+	return contentLength >= 0 && length < contentLength
+}
+
+// parseContentLength returns the value of a Content-Length header, or -1 if
+// it is not one or invalid.
+func parseContentLength(key, value string) int64 {
+	if !strings.EqualFold(key, "content-length") {
+		return -1
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// responseHasBody reports if a response to the request method may have a
+// body, see RFC 9110 section 6.4.1.
+func responseHasBody(method string, status int64) bool {
+	switch {
+	case method == http.MethodHead:
+		return false
+	case status >= 100 && status < 200, status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	default:
+		return true
+	}
+}
+
+// handleTruncatedBody records a truncated body in the tx.<direction>_body_truncated
+// variable and applies the truncated body policy. It reports whether the
+// body must be skipped.
+func (a *Application) handleTruncatedBody(tx types.Transaction, direction string) (skipBody bool, err error) {
+	truncatedBodies.WithLabelValues(a.Name, direction).Inc()
+	a.Logger.Debug().Str("tx", tx.ID()).Str("direction", direction).Str("policy", string(a.TruncatedBody)).Msg("body is truncated")
+
+	if txState, ok := tx.(plugintypes.TransactionState); ok {
+		txState.Variables().TX().Set(direction+"_body_truncated", []string{"1"})
+	}
+
+	switch a.TruncatedBody {
+	case TruncatedBodyDeny:
+		return false, ErrInterrupted{&types.Interruption{
+			Action: "deny",
+			Status: http.StatusRequestEntityTooLarge,
+			Data:   direction + " body truncated",
+		}}
+	case TruncatedBodySkipBody:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
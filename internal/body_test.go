@@ -0,0 +1,162 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBodyTruncated(t *testing.T) {
+	complete, incomplete := true, false
+
+	tests := []struct {
+		name          string
+		bodyComplete  *bool
+		length        int64
+		contentLength int64
+		want          bool
+	}{
+		{name: "shorter than content length", length: 10, contentLength: 100, want: true},
+		{name: "equal to content length", length: 100, contentLength: 100},
+		{name: "unknown content length", length: 10, contentLength: -1},
+		{name: "explicitly complete", bodyComplete: &complete, length: 10, contentLength: 100},
+		{name: "explicitly incomplete", bodyComplete: &incomplete, length: 10, contentLength: -1, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bodyTruncated(tt.bodyComplete, tt.length, tt.contentLength); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestApplication_TruncatedRequestBody(t *testing.T) {
+	tests := []struct {
+		policy       TruncatedBodyPolicy
+		bodyComplete bool
+		wantStatus   any
+	}{
+		// rule 2 matches the partial body
+		{policy: TruncatedBodyInspectPartial, wantStatus: int64(403)},
+		{policy: TruncatedBodyDeny, wantStatus: int64(413)},
+		{policy: TruncatedBodySkipBody, wantStatus: nil},
+		// body-complete overrides the Content-Length
+		{policy: TruncatedBodyDeny, bodyComplete: true, wantStatus: int64(403)},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			a := newTestAgent(t, "default")
+			app := a.Applications["default"]
+			app.TruncatedBody = tt.policy
+			truncated := testutil.ToFloat64(truncatedBodies.WithLabelValues("default", directionRequest))
+
+			msg := buildMessage(t, "coraza-req", func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", "default"); err != nil {
+					return err
+				}
+				if err := kw.SetString("method", "POST"); err != nil {
+					return err
+				}
+				if err := kw.SetString("headers", "content-type: application/x-www-form-urlencoded\r\ncontent-length: 100\r\n"); err != nil {
+					return err
+				}
+				if tt.bodyComplete {
+					if err := kw.SetBool("body-complete", true); err != nil {
+						return err
+					}
+				}
+				return kw.SetBinary("body", []byte("evilpayload"))
+			})
+			aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+			a.HandleSPOE(context.Background(), aw, msg)
+
+			vars := actionVars(t, aw)
+			if got := vars["status"]; got != tt.wantStatus {
+				t.Errorf("expected status %v, got %v", tt.wantStatus, got)
+			}
+
+			wantTruncated := truncated + 1
+			if tt.bodyComplete {
+				wantTruncated = truncated
+			}
+			if got := testutil.ToFloat64(truncatedBodies.WithLabelValues("default", directionRequest)); got != wantTruncated {
+				t.Errorf("expected %v truncated bodies, got %v", wantTruncated, got)
+			}
+
+			if tt.wantStatus != nil {
+				return
+			}
+			// Passed transactions are cached for the response.
+			cv, ok := app.cache.Get(vars["id"].(string))
+			if !ok {
+				t.Fatal("expected transaction to be cached")
+			}
+			tx := cv.(*transaction).tx.(plugintypes.TransactionState)
+			if got := tx.Variables().TX().Get("request_body_truncated"); len(got) != 1 || got[0] != "1" {
+				t.Errorf("expected tx.request_body_truncated to be set, got %v", got)
+			}
+		})
+	}
+}
+
+func TestApplication_TruncatedResponseBody(t *testing.T) {
+	tests := []struct {
+		method     string
+		status     int64
+		wantStatus any
+	}{
+		{method: "GET", status: 200, wantStatus: int64(413)},
+		{method: "HEAD", status: 200},
+		{method: "GET", status: 304},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d", tt.method, tt.status), func(t *testing.T) {
+			a := newTestAgent(t, "default")
+			a.Applications["default"].TruncatedBody = TruncatedBodyDeny
+
+			send := func(name string, fn func(kw *encoding.KVWriter) error) map[string]any {
+				msg := buildMessage(t, name, func(kw *encoding.KVWriter) error {
+					if err := kw.SetString("app", "default"); err != nil {
+						return err
+					}
+					return fn(kw)
+				})
+				aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+				a.HandleSPOE(context.Background(), aw, msg)
+				return actionVars(t, aw)
+			}
+
+			vars := send("coraza-req", func(kw *encoding.KVWriter) error {
+				return kw.SetString("method", tt.method)
+			})
+			id := vars["id"].(string)
+
+			vars = send("coraza-res", func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("id", id); err != nil {
+					return err
+				}
+				if err := kw.SetInt64("status", tt.status); err != nil {
+					return err
+				}
+				if err := kw.SetString("headers", "content-length: 100\r\n"); err != nil {
+					return err
+				}
+				return kw.SetBinary("body", []byte("short"))
+			})
+			if got := vars["status"]; got != tt.wantStatus {
+				t.Errorf("expected status %v, got %v", tt.wantStatus, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirectivesHash returns the hex encoded SHA-256 of the directives, the
+// directives files and all files they include. Includes of the embedded
+// CRS, like @owasp_crs/*.conf, do not change and are not read.
+func DirectivesHash(directives string, files []string) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(directives))
+	seen := make(map[string]bool)
+	// Coraza resolves includes of inline directives against the working
+	// directory.
+	if err := hashIncludes(h, directives, "", seen); err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if err := hashFile(h, file, seen); err != nil {
+			return "", fmt.Errorf("reading directives file: %v", err)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func hashFile(h hash.Hash, file string, seen map[string]bool) error {
+	if seen[file] {
+		return nil
+	}
+	seen[file] = true
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	// the lengths keep the boundaries between the inputs unambiguous
+	fmt.Fprintf(h, "\x00%d:%s%d:", len(file), file, len(data))
+	h.Write(data)
+	return hashIncludes(h, string(data), filepath.Dir(file), seen)
+}
+
+// hashIncludes hashes the files included by the directives, relative paths
+// are relative to dir.
+func hashIncludes(h hash.Hash, directives string, dir string, seen map[string]bool) error {
+	for _, line := range strings.Split(directives, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "Include") {
+			continue
+		}
+		path := strings.Trim(fields[1], `"'`)
+		if strings.HasPrefix(path, "@") {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		files := []string{path}
+		if strings.Contains(path, "*") {
+			var err error
+			if files, err = filepath.Glob(path); err != nil {
+				return fmt.Errorf("invalid include %q: %v", path, err)
+			}
+		}
+		for _, file := range files {
+			if err := hashFile(h, file, seen); err != nil {
+				return fmt.Errorf("reading included file: %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectivesHash(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func(directives string, files ...string) string {
+		t.Helper()
+		h, err := DirectivesHash(directives, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	const inline = "SecRuleEngine On\nInclude @owasp_crs/*.conf"
+	if got, want := hash(inline), fmt.Sprintf("%x", sha256.Sum256([]byte(inline))); got != want {
+		t.Errorf("expected the hash of the inline directives %s, got %s", want, got)
+	}
+
+	base := filepath.Join(dir, "base.conf")
+	writeFile("base.conf", "Include rules/*.conf\nInclude base.conf\n")
+	if err := os.Mkdir(filepath.Join(dir, "rules"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("rules/a.conf", `SecAction "id:1,phase:1,pass,nolog"`)
+	before := hash(inline, base)
+
+	writeFile("rules/a.conf", `SecAction "id:2,phase:1,pass,nolog"`)
+	if hash(inline, base) == before {
+		t.Error("expected the hash to change with an included file")
+	}
+
+	writeFile("rules/b.conf", `SecAction "id:3,phase:1,pass,nolog"`)
+	changed := hash(inline, base)
+	if changed == before {
+		t.Error("expected the hash to change with a file matching an include")
+	}
+	if hash(inline, base) != changed {
+		t.Error("expected the hash to be stable")
+	}
+
+	if _, err := DirectivesHash("Include "+filepath.Join(dir, "missing.conf"), nil); err == nil {
+		t.Error("expected error for a missing included file")
+	}
+}
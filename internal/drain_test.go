@@ -106,7 +106,7 @@ func TestDrainDetectOnly_FallbackToSync(t *testing.T) {
 	aw, msg := buildDetectOnlyMessage(t, tx.ID())
 
 	// HandleResponse should execute synchronously (no goroutine spawned).
-	err := app.HandleResponse(context.Background(), aw, msg)
+	err := app.HandleResponse(context.Background(), aw, msg.KV)
 	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
@@ -157,7 +157,7 @@ func TestDrainDetectOnly_ConcurrentRace(t *testing.T) {
 
 			entered.Add(1)
 			aw, msg := buildDetectOnlyMessage(t, id)
-			if err := app.HandleResponse(context.Background(), aw, msg); err != nil {
+			if err := app.HandleResponse(context.Background(), aw, msg.KV); err != nil {
 				return
 			}
 			completed.Add(1)
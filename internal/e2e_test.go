@@ -210,6 +210,8 @@ func runCoraza(tb testing.TB, directives string) (testutil.HAProxyConfig, string
     # Deny in case of an error, when processing with the Coraza SPOA
     http-request deny deny_status 504 if { var(txn.e2e.error) -m int gt 0 }
     http-response deny deny_status 504 if { var(txn.e2e.error) -m int gt 0 }
+    http-request deny deny_status 504 if { var(txn.e2e.fail_action) -m str deny }
+    http-response deny deny_status 504 if { var(txn.e2e.fail_action) -m str deny }
 `,
 		EngineConfig: `
 [e2e]
@@ -278,6 +280,8 @@ func runCorazaDetectOnly(tb testing.TB, directives string) (testutil.HAProxyConf
     # Deny in case of an error, when processing with the Coraza SPOA
     http-request deny deny_status 504 if { var(txn.e2e.error) -m int gt 0 }
     http-response deny deny_status 504 if { var(txn.e2e.error) -m int gt 0 }
+    http-request deny deny_status 504 if { var(txn.e2e.fail_action) -m str deny }
+    http-response deny deny_status 504 if { var(txn.e2e.fail_action) -m str deny }
 `,
 		EngineConfig: `
 [e2e]
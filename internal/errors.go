@@ -0,0 +1,58 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"fmt"
+)
+
+// ErrorReason classifies why a message could not be processed. It is
+// exported to HAProxy as the error_reason variable.
+type ErrorReason string
+
+const (
+	ErrorReasonAppNotFound ErrorReason = "app_not_found"
+	ErrorReasonTxNotFound  ErrorReason = "tx_not_found"
+	ErrorReasonInvalidID   ErrorReason = "invalid_id"
+	ErrorReasonHeaderParse ErrorReason = "header_parse"
+	ErrorReasonBodyWrite   ErrorReason = "body_write"
+	ErrorReasonInternal    ErrorReason = "internal"
+)
+
+// FailAction tells HAProxy how to treat a request that could not be
+// processed. It is exported to HAProxy as the fail_action variable.
+type FailAction string
+
+const (
+	FailActionAllow FailAction = "allow"
+	FailActionDeny  FailAction = "deny"
+)
+
+// ParseFailAction parses the on_error policy. An empty value defaults to
+// FailActionDeny.
+func ParseFailAction(s string) (FailAction, error) {
+	switch FailAction(s) {
+	case "":
+		return FailActionDeny, nil
+	case FailActionAllow, FailActionDeny:
+		return FailAction(s), nil
+	default:
+		return "", fmt.Errorf("unknown on_error action: %q", s)
+	}
+}
+
+// ErrFailed is returned by the message handlers if a message could not be
+// processed. Errors without a reason are treated as ErrorReasonInternal.
+type ErrFailed struct {
+	Reason ErrorReason
+	Err    error
+}
+
+func (e ErrFailed) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e ErrFailed) Unwrap() error {
+	return e.Err
+}
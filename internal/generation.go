@@ -0,0 +1,150 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"time"
+)
+
+// generation is a set of applications that was replaced by a reload. Its
+// applications keep their cached transactions until those are completed
+// or expired, and are closed afterward.
+type generation struct {
+	apps      []*Application
+	retiredAt time.Time
+}
+
+func newGeneration(apps []*Application, now time.Time) *generation {
+	return &generation{
+		apps:      apps,
+		retiredAt: now,
+	}
+}
+
+// releasable reports if no message uses the generation anymore and all of
+// its transactions were either completed or expired. Transactions which
+// are continued after the retirement are cached again with a fresh TTL,
+// so the expiry is taken from the caches.
+func (g *generation) releasable(now time.Time) bool {
+	for _, app := range g.apps {
+		if app.refs.Load() > 0 {
+			return false
+		}
+		if now.Before(app.cache.maxExpiry()) {
+			return false
+		}
+	}
+	return true
+}
+
+// close stops the eviction of all applications of the generation and
+// closes their remaining transactions.
+func (g *generation) close() {
+	for _, app := range g.apps {
+		app.Close()
+	}
+}
+
+// retire moves all applications that are not part of the current ones
+// into a new generation.
+func (a *Agent) retire(oldApps map[string]*Application, oldDefault *Application) {
+	current := make(map[*Application]struct{}, len(a.Applications)+1)
+	for _, app := range a.Applications {
+		current[app] = struct{}{}
+	}
+	if a.DefaultApplication != nil {
+		current[a.DefaultApplication] = struct{}{}
+	}
+
+	var retired []*Application
+	seen := make(map[*Application]struct{}, len(oldApps)+1)
+	for _, app := range append(mapValues(oldApps), oldDefault) {
+		if app == nil {
+			continue
+		}
+		if _, ok := current[app]; ok {
+			continue
+		}
+		if _, ok := seen[app]; ok {
+			continue
+		}
+		seen[app] = struct{}{}
+		retired = append(retired, app)
+	}
+	if len(retired) == 0 {
+		return
+	}
+
+	a.generations = append(a.generations, newGeneration(retired, time.Now()))
+	retiredGenerations.Set(float64(len(a.generations)))
+	a.releaseOnce.Do(func() {
+		go a.releaseLoop()
+	})
+}
+
+// retiredOwner returns the application of a retired generation that holds
+// the transaction, starting with the most recent generation. The caller
+// must hold the agent lock.
+func (a *Agent) retiredOwner(txID string) *Application {
+	for i := len(a.generations) - 1; i >= 0; i-- {
+		for _, app := range a.generations[i].apps {
+			if app.hasTransaction(txID) {
+				return app
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Agent) releaseLoop() {
+	const releaseInterval = time.Second
+	ticker := time.NewTicker(releaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.Context.Done():
+			return
+		case <-ticker.C:
+			a.releaseGenerations(false)
+		}
+	}
+}
+
+// releaseGenerations closes all retired generations which are releasable,
+// or all of them if force is set.
+func (a *Agent) releaseGenerations(force bool) {
+	now := time.Now()
+	var released []*generation
+
+	a.mtx.Lock()
+	kept := a.generations[:0]
+	for _, g := range a.generations {
+		if force || g.releasable(now) {
+			released = append(released, g)
+			continue
+		}
+		kept = append(kept, g)
+	}
+	// clear the references of released generations
+	clear(a.generations[len(kept):])
+	a.generations = kept
+	retiredGenerations.Set(float64(len(a.generations)))
+	a.mtx.Unlock()
+
+	for _, g := range released {
+		g.close()
+		a.Logger.Debug().
+			Int("apps", len(g.apps)).
+			Dur("age", now.Sub(g.retiredAt)).
+			Msg("released application generation")
+	}
+}
+
+func mapValues[K comparable, V any](m map[K]V) []V {
+	values := make([]V, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
@@ -0,0 +1,209 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAgent_ReplaceApplicationsRetiresGeneration(t *testing.T) {
+	a := newTestAgent(t, "app")
+	oldApp := a.Applications["app"]
+	a.DefaultApplication = oldApp
+
+	tx := oldApp.waf.NewTransactionWithID("generation-test")
+	oldApp.cacheTransaction(&transaction{tx: tx})
+
+	next := newTestAgent(t, "app")
+	a.ReplaceApplications(next.Applications, next.Applications["app"])
+
+	if len(a.generations) != 1 {
+		t.Fatalf("expected one retired generation, got %d", len(a.generations))
+	}
+	if got := a.generations[0].apps; len(got) != 1 || got[0] != oldApp {
+		t.Fatalf("expected old app to be retired, got %v", got)
+	}
+
+	// The cached transaction keeps the generation alive.
+	a.releaseGenerations(false)
+	if len(a.generations) != 1 {
+		t.Fatal("expected generation with cached transactions to be kept")
+	}
+
+	if _, err := oldApp.takeTransaction(tx.ID(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message in flight keeps the generation alive.
+	oldApp.acquire()
+	a.releaseGenerations(false)
+	if len(a.generations) != 1 {
+		t.Fatal("expected generation in use to be kept")
+	}
+	oldApp.release()
+
+	a.releaseGenerations(false)
+	if len(a.generations) != 0 {
+		t.Fatal("expected idle generation to be released")
+	}
+
+	select {
+	case <-oldApp.cache.done:
+	default:
+		t.Error("expected cache of released app to be stopped")
+	}
+}
+
+func TestGeneration_ReleasableAfterTTL(t *testing.T) {
+	a := newTestAgent(t, "app")
+	app := a.Applications["app"]
+
+	tx := app.waf.NewTransactionWithID("generation-ttl-test")
+	app.cacheTransaction(&transaction{tx: tx})
+
+	now := time.Now()
+	g := newGeneration([]*Application{app}, now)
+	if g.releasable(now) {
+		t.Error("expected generation with cached transactions not to be releasable")
+	}
+	if !g.releasable(now.Add(app.TransactionTTL)) {
+		t.Error("expected generation to be releasable after the transaction TTL")
+	}
+}
+
+func TestAgent_RequestBodyAcrossReload(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	a := newTestAgentWith(t, testDirectives, func(c *AppConfig) {
+		c.TransactionTTL = ttl
+		c.ResponseCheck = true
+	}, "app")
+
+	send := func(name string, fn func(kw *encoding.KVWriter) error) map[string]any {
+		msg := buildMessage(t, name, func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("app", "app"); err != nil {
+				return err
+			}
+			return fn(kw)
+		})
+		aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+		a.HandleSPOE(context.Background(), aw, msg)
+		return actionVars(t, aw)
+	}
+
+	vars := send("coraza-req", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("method", "POST"); err != nil {
+			return err
+		}
+		if err := kw.SetBinary("body", []byte("a=")); err != nil {
+			return err
+		}
+		return kw.SetBool("more-body", true)
+	})
+	id := vars["id"].(string)
+
+	next := newTestAgent(t, "app")
+	a.ReplaceApplications(next.Applications, nil)
+	expiresAt := time.Now().Add(ttl)
+
+	// the chunk caches the transaction of the retired app with a fresh TTL
+	time.Sleep(ttl / 2)
+	vars = send("coraza-req-body", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("id", id); err != nil {
+			return err
+		}
+		return kw.SetBinary("body", []byte("b"))
+	})
+	if vars["action"] != nil || vars["error_reason"] != nil {
+		t.Fatalf("expected the last chunk to pass, got %v", vars)
+	}
+
+	time.Sleep(time.Until(expiresAt) + 10*time.Millisecond)
+	a.releaseGenerations(false)
+	if len(a.generations) != 1 {
+		t.Fatal("expected generation with a continued transaction to be kept")
+	}
+
+	vars = send("coraza-res", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("id", id); err != nil {
+			return err
+		}
+		if err := kw.SetString("version", "1.1"); err != nil {
+			return err
+		}
+		return kw.SetInt32("status", 200)
+	})
+	if vars["error_reason"] != nil {
+		t.Fatalf("expected the response to find the transaction, got %v", vars)
+	}
+
+	a.releaseGenerations(false)
+	if len(a.generations) != 0 {
+		t.Error("expected generation to be released after the response")
+	}
+}
+
+func TestAgent_ReplaceApplicationsKeepsReusedApps(t *testing.T) {
+	a := newTestAgent(t, "a", "b")
+	apps := map[string]*Application{"a": a.Applications["a"]}
+
+	a.ReplaceApplications(apps, nil)
+
+	if len(a.generations) != 1 {
+		t.Fatalf("expected one retired generation, got %d", len(a.generations))
+	}
+	if got := a.generations[0].apps; len(got) != 1 || got[0].Name != "b" {
+		t.Errorf("expected only app b to be retired, got %v", got)
+	}
+}
+
+func TestAgent_ResponseAcrossReload(t *testing.T) {
+	a := newTestAgent(t, "app")
+	oldApp := a.Applications["app"]
+
+	send := func(name string, fn func(kw *encoding.KVWriter) error) map[string]any {
+		msg := buildMessage(t, name, func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("app", "app"); err != nil {
+				return err
+			}
+			return fn(kw)
+		})
+		aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+		a.HandleSPOE(context.Background(), aw, msg)
+		return actionVars(t, aw)
+	}
+
+	vars := send("coraza-req", func(kw *encoding.KVWriter) error {
+		return kw.SetString("path", "/")
+	})
+	id := vars["id"].(string)
+
+	next := newTestAgent(t, "app")
+	a.ReplaceApplications(next.Applications, nil)
+
+	lookups := testutil.ToFloat64(crossGenerationLookups.WithLabelValues("app", "coraza-res"))
+
+	vars = send("coraza-res", func(kw *encoding.KVWriter) error {
+		if err := kw.SetString("id", id); err != nil {
+			return err
+		}
+		if err := kw.SetString("version", "1.1"); err != nil {
+			return err
+		}
+		return kw.SetInt32("status", 200)
+	})
+	if vars["error_reason"] != nil {
+		t.Fatalf("expected response to be handled by the retired generation, got %v", vars)
+	}
+	if oldApp.hasTransaction(id) {
+		t.Error("expected transaction to be completed")
+	}
+	if got := testutil.ToFloat64(crossGenerationLookups.WithLabelValues("app", "coraza-res")); got != lookups+1 {
+		t.Errorf("expected %v cross generation lookups, got %v", lookups+1, got)
+	}
+}
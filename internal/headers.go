@@ -0,0 +1,159 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+// HeadersFormat is the encoding of the headers argument, selected with the
+// headers-format argument.
+type HeadersFormat string
+
+const (
+	// HeadersFormatAuto detects the format of the headers. It is used if
+	// no format is sent.
+	HeadersFormatAuto HeadersFormat = "auto"
+	// HeadersFormatText is the format of req.hdrs and res.hdrs.
+	HeadersFormatText HeadersFormat = "text"
+	// HeadersFormatBinary is the format of req.hdrs_bin and res.hdrs_bin.
+	HeadersFormatBinary HeadersFormat = "binary"
+)
+
+func parseHeadersFormat(s string) (HeadersFormat, error) {
+	switch HeadersFormat(s) {
+	case "", HeadersFormatAuto:
+		return HeadersFormatAuto, nil
+	case HeadersFormatText, HeadersFormatBinary:
+		return HeadersFormat(s), nil
+	default:
+		return "", fmt.Errorf("unknown headers format: %q", s)
+	}
+}
+
+// readHeaders calls hdrCallback for each header and hostCallback for the
+// host header, if it is not nil.
+func readHeaders(headers []byte, format HeadersFormat, hdrCallback func(key string, value string), hostCallback func(value string)) error {
+	callback := func(key, value []byte) {
+		if hostCallback != nil && bytes.EqualFold(key, []byte("host")) {
+			hostCallback(string(value))
+		}
+		hdrCallback(string(key), string(value))
+	}
+
+	switch format {
+	case HeadersFormatBinary:
+		return readBinaryHeaders(headers, callback)
+	case HeadersFormatText:
+		return readTextHeaders(headers, callback)
+	default:
+		if isBinaryHeaders(headers) {
+			return readBinaryHeaders(headers, callback)
+		}
+		return readTextHeaders(headers, callback)
+	}
+}
+
+// readTextHeaders parses headers separated by line breaks. Unlike a
+// bufio.Scanner, it does not limit the length of a line.
+func readTextHeaders(headers []byte, callback func(key, value []byte)) error {
+	for len(headers) > 0 {
+		var line []byte
+		line, headers, _ = bytes.Cut(headers, []byte("\n"))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		key, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			return fmt.Errorf("invalid header: %q", line)
+		}
+
+		callback(bytes.TrimSpace(key), bytes.TrimSpace(value))
+	}
+
+	return nil
+}
+
+// readBinaryHeaders parses the length-prefixed encoding of hdrs_bin: a
+// varint length and the bytes of the name and the value of each header,
+// terminated by an empty name and value. Names and values are passed on
+// without modification.
+func readBinaryHeaders(headers []byte, callback func(key, value []byte)) error {
+	for {
+		key, rest, err := readBinaryString(headers)
+		if err != nil {
+			return fmt.Errorf("reading header name: %v", err)
+		}
+		value, rest, err := readBinaryString(rest)
+		if err != nil {
+			return fmt.Errorf("reading value of header %q: %v", key, err)
+		}
+		headers = rest
+
+		if len(key) == 0 {
+			if len(value) != 0 {
+				return fmt.Errorf("header without name")
+			}
+			// end of headers
+			return nil
+		}
+		callback(key, value)
+	}
+}
+
+func readBinaryString(b []byte) ([]byte, []byte, error) {
+	l, n, err := encoding.Varint(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	b = b[n:]
+	if l > uint64(len(b)) {
+		return nil, nil, fmt.Errorf("length %d exceeds remaining %d bytes", l, len(b))
+	}
+	return b[:l], b[l:], nil
+}
+
+// isBinaryHeaders reports if the headers are in the hdrs_bin format. They
+// have to consist of header names which are valid tokens, followed by the
+// terminator and nothing else. Text headers practically never pass this,
+// as their first byte would be taken as a name length covering spaces or
+// colons.
+func isBinaryHeaders(headers []byte) bool {
+	for {
+		key, rest, err := readBinaryString(headers)
+		if err != nil {
+			return false
+		}
+		value, rest, err := readBinaryString(rest)
+		if err != nil {
+			return false
+		}
+		headers = rest
+
+		if len(key) == 0 {
+			return len(value) == 0 && len(headers) == 0
+		}
+		if !isToken(key) {
+			return false
+		}
+	}
+}
+
+// isToken reports if b is a valid header name as defined in RFC 9110.
+func isToken(b []byte) bool {
+	for _, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case bytes.IndexByte([]byte("!#$%&'*+-.^_`|~"), c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
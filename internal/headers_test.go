@@ -0,0 +1,131 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+// binaryHeaders encodes name and value pairs like req.hdrs_bin.
+func binaryHeaders(t *testing.T, kv ...string) []byte {
+	t.Helper()
+
+	var buf []byte
+	var lenBuf [10]byte
+	for _, s := range append(kv, "", "") {
+		n, err := encoding.PutVarint(lenBuf[:], uint64(len(s)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, lenBuf[:n]...)
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+func TestReadHeaders(t *testing.T) {
+	longValue := strings.Repeat("a", 100*1024)
+
+	tests := []struct {
+		name     string
+		headers  []byte
+		format   HeadersFormat
+		want     [][2]string
+		wantHost string
+		wantErr  bool
+	}{
+		{
+			name:     "text",
+			headers:  []byte("Host: example.com\r\nAccept: */*\r\n\r\n"),
+			format:   HeadersFormatText,
+			want:     [][2]string{{"Host", "example.com"}, {"Accept", "*/*"}},
+			wantHost: "example.com",
+		},
+		{
+			name:    "text line longer than 64 KiB",
+			headers: []byte("X-Long: " + longValue + "\r\n"),
+			format:  HeadersFormatAuto,
+			want:    [][2]string{{"X-Long", longValue}},
+		},
+		{
+			name:    "invalid text",
+			headers: []byte("no-colon\r\n"),
+			format:  HeadersFormatText,
+			wantErr: true,
+		},
+		{
+			name:     "binary",
+			headers:  binaryHeaders(t, "host", "example.com", "x-odd", " a:b\r\nc "),
+			format:   HeadersFormatBinary,
+			want:     [][2]string{{"host", "example.com"}, {"x-odd", " a:b\r\nc "}},
+			wantHost: "example.com",
+		},
+		{
+			name:     "binary detected",
+			headers:  binaryHeaders(t, "HOST", "example.com", "x-empty", ""),
+			format:   HeadersFormatAuto,
+			want:     [][2]string{{"HOST", "example.com"}, {"x-empty", ""}},
+			wantHost: "example.com",
+		},
+		{
+			name:    "binary without terminator",
+			headers: binaryHeaders(t, "host", "example.com")[:17],
+			format:  HeadersFormatBinary,
+			wantErr: true,
+		},
+		{
+			name:    "binary length exceeds buffer",
+			headers: []byte{0x10, 'h', 'o', 's', 't'},
+			format:  HeadersFormatBinary,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][2]string
+			var host string
+			err := readHeaders(tt.headers, tt.format, func(key, value string) {
+				got = append(got, [2]string{key, value})
+			}, func(value string) {
+				host = value
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected headers %q, got %q", tt.want, got)
+			}
+			if host != tt.wantHost {
+				t.Errorf("expected host %q, got %q", tt.wantHost, host)
+			}
+		})
+	}
+}
+
+func TestIsBinaryHeaders(t *testing.T) {
+	tests := []struct {
+		headers []byte
+		want    bool
+	}{
+		{headers: binaryHeaders(t, "host", "example.com"), want: true},
+		{headers: binaryHeaders(t), want: true},
+		{headers: []byte("Host: example.com\r\n\r\n"), want: false},
+		{headers: []byte("\x04host\x0bexample.com\r\n"), want: false},
+		{headers: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isBinaryHeaders(tt.headers); got != tt.want {
+			t.Errorf("isBinaryHeaders(%q) = %v, want %v", tt.headers, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// IDGenerator creates the transaction ids of requests for which HAProxy
+// does not send an id.
+type IDGenerator interface {
+	NewID() string
+}
+
+const (
+	IDGeneratorUUIDv4  = "uuidv4"
+	IDGeneratorUUIDv7  = "uuidv7"
+	IDGeneratorULID    = "ulid"
+	IDGeneratorCounter = "counter"
+)
+
+// DefaultMaxIDLength limits the length of ids sent by HAProxy.
+const DefaultMaxIDLength = 128
+
+type IDGeneratorConfig struct {
+	// Type is one of uuidv4, uuidv7, ulid or counter. It defaults to uuidv7.
+	Type string
+	// Prefix and NodeID are only used by the counter generator. NodeID
+	// defaults to the hostname.
+	Prefix string
+	NodeID string
+}
+
+func (c IDGeneratorConfig) NewIDGenerator() (IDGenerator, error) {
+	switch c.Type {
+	case "", IDGeneratorUUIDv7:
+		return uuidV7Generator{}, nil
+	case IDGeneratorUUIDv4:
+		return uuidV4Generator{}, nil
+	case IDGeneratorULID:
+		return ulidGenerator{}, nil
+	case IDGeneratorCounter:
+		node := c.NodeID
+		if node == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("node id is not set and hostname is unknown: %v", err)
+			}
+			node = hostname
+		}
+		prefix := counterPrefix(c.Prefix, node, processStart)
+		if err := validateID(prefix, DefaultMaxIDLength); err != nil {
+			return nil, fmt.Errorf("invalid prefix or node id: %v", err)
+		}
+		return counterGenerator{prefix: prefix}, nil
+	default:
+		return nil, fmt.Errorf("unknown id generator: %q", c.Type)
+	}
+}
+
+type uuidV4Generator struct{}
+
+func (uuidV4Generator) NewID() string {
+	var u [16]byte
+	_, _ = rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // variant 10
+	return formatUUID(u)
+}
+
+// uuidV7Generator creates time-ordered UUIDs as specified in RFC 9562.
+type uuidV7Generator struct{}
+
+func (uuidV7Generator) NewID() string {
+	var u [16]byte
+	_, _ = rand.Read(u[6:])
+	putMillis(u[:6], time.Now())
+	u[6] = u[6]&0x0f | 0x70 // version 7
+	u[8] = u[8]&0x3f | 0x80 // variant 10
+	return formatUUID(u)
+}
+
+func formatUUID(u [16]byte) string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+// putMillis writes the unix time in milliseconds as 48-bit big endian.
+func putMillis(b []byte, t time.Time) {
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixMilli()))
+	copy(b, ms[2:])
+}
+
+// ulidGenerator creates lexicographically sortable ids, see
+// https://github.com/ulid/spec.
+type ulidGenerator struct{}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (ulidGenerator) NewID() string {
+	var u [16]byte
+	putMillis(u[:6], time.Now())
+	_, _ = rand.Read(u[6:])
+
+	// 128 bits are encoded as 26 characters of 5 bits, the first
+	// character only holds the 3 most significant bits.
+	hi := binary.BigEndian.Uint64(u[:8])
+	lo := binary.BigEndian.Uint64(u[8:])
+	var buf [26]byte
+	for i := len(buf) - 1; i >= 0; i-- {
+		buf[i] = crockfordBase32[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(buf[:])
+}
+
+// idCounter is shared by all counter generators, so ids stay unique
+// across applications and reloads.
+var idCounter atomic.Uint64
+
+// processStart is part of the ids of the counter generator, as the counter
+// restarts at 1 with every process.
+var processStart = time.Now()
+
+type counterGenerator struct {
+	prefix string
+}
+
+// counterPrefix returns the prefix of the counter ids, with the start of
+// the process in milliseconds encoded in base 36.
+func counterPrefix(prefix, node string, start time.Time) string {
+	return prefix + node + "-" + strconv.FormatInt(start.UnixMilli(), 36) + "-"
+}
+
+func (g counterGenerator) NewID() string {
+	return g.prefix + strconv.FormatUint(idCounter.Add(1), 10)
+}
+
+// validateID checks an id sent by HAProxy. Ids are used as cache keys and
+// are logged, so they are limited to printable ASCII without spaces.
+func validateID(id string, maxLength int) error {
+	if len(id) > maxLength {
+		return fmt.Errorf("id exceeds %d bytes", maxLength)
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c <= ' ' || c > '~' {
+			return fmt.Errorf("id contains invalid character %q at position %d", c, i)
+		}
+	}
+	return nil
+}
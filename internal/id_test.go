@@ -0,0 +1,144 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+func TestIDGenerator(t *testing.T) {
+	tests := []struct {
+		config IDGeneratorConfig
+		want   *regexp.Regexp
+	}{
+		{
+			config: IDGeneratorConfig{},
+			want:   regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		},
+		{
+			config: IDGeneratorConfig{Type: IDGeneratorUUIDv4},
+			want:   regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		},
+		{
+			config: IDGeneratorConfig{Type: IDGeneratorULID},
+			want:   regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`),
+		},
+		{
+			config: IDGeneratorConfig{Type: IDGeneratorCounter, Prefix: "waf-", NodeID: "node1"},
+			want:   regexp.MustCompile(`^waf-node1-[0-9a-z]+-[0-9]+$`),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.config.Type, func(t *testing.T) {
+			g, err := tt.config.NewIDGenerator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := make(map[string]struct{})
+			for i := 0; i < 1000; i++ {
+				id := g.NewID()
+				if !tt.want.MatchString(id) {
+					t.Fatalf("unexpected id format: %q", id)
+				}
+				if _, ok := seen[id]; ok {
+					t.Fatalf("duplicate id: %q", id)
+				}
+				seen[id] = struct{}{}
+			}
+		})
+	}
+}
+
+func TestIDGenerator_Sortable(t *testing.T) {
+	for _, typ := range []string{IDGeneratorUUIDv7, IDGeneratorULID} {
+		g, err := IDGeneratorConfig{Type: typ}.NewIDGenerator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := g.NewID()
+		time.Sleep(2 * time.Millisecond)
+		if second := g.NewID(); second <= first {
+			t.Errorf("%s: expected %q to sort after %q", typ, second, first)
+		}
+	}
+}
+
+func TestIDGenerator_CounterRestart(t *testing.T) {
+	defer idCounter.Store(idCounter.Load())
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var ids []string
+	for _, restart := range []time.Time{start, start.Add(time.Second)} {
+		idCounter.Store(0)
+		g := counterGenerator{prefix: counterPrefix("waf-", "node1", restart)}
+		ids = append(ids, g.NewID())
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("expected ids of different processes to differ, got %q twice", ids[0])
+	}
+	if want := "waf-node1-mjuohs00-1"; ids[0] != want {
+		t.Errorf("expected id %q, got %q", want, ids[0])
+	}
+}
+
+func TestIDGenerator_Unknown(t *testing.T) {
+	if _, err := (IDGeneratorConfig{Type: "uuidv1"}).NewIDGenerator(); err == nil {
+		t.Error("expected error for unknown generator")
+	}
+	if _, err := (IDGeneratorConfig{Type: IDGeneratorCounter, NodeID: "with space"}).NewIDGenerator(); err == nil {
+		t.Error("expected error for invalid node id")
+	}
+}
+
+func TestValidateID(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{id: "01J2XK7T9Q8M3N4P"},
+		{id: "haproxy:1234/abc"},
+		{id: strings.Repeat("a", 16)},
+		{id: strings.Repeat("a", 17), wantErr: true},
+		{id: "with space", wantErr: true},
+		{id: "tab\t", wantErr: true},
+		{id: "non-ascii-\xc3\xa4", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := validateID(tt.id, 16); (err != nil) != tt.wantErr {
+			t.Errorf("validateID(%q) = %v, want error %v", tt.id, err, tt.wantErr)
+		}
+	}
+}
+
+func TestApplication_DuplicateID(t *testing.T) {
+	a := newTestAgent(t, "default")
+
+	send := func() map[string]any {
+		msg := buildMessage(t, "coraza-req", func(kw *encoding.KVWriter) error {
+			if err := kw.SetString("app", "default"); err != nil {
+				return err
+			}
+			return kw.SetString("id", "same-id")
+		})
+		aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+		a.HandleSPOE(context.Background(), aw, msg)
+		return actionVars(t, aw)
+	}
+
+	if vars := send(); vars["error_reason"] != nil {
+		t.Fatalf("unexpected error for first request: %v", vars["error_reason"])
+	}
+	// The transaction is cached for the response check.
+	if vars := send(); vars["error_reason"] != string(ErrorReasonInvalidID) {
+		t.Errorf("expected error_reason %q, got %v", ErrorReasonInvalidID, vars["error_reason"])
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+// InterruptionField is an optional variable exported to HAProxy on an
+// interruption, in addition to status, action, data and ruleid. The
+// variable has the same name as the field.
+type InterruptionField string
+
+const (
+	// InterruptionFieldMsg is the message of the interrupting rule.
+	InterruptionFieldMsg InterruptionField = "msg"
+	// InterruptionFieldSeverity is the severity of the interrupting rule.
+	InterruptionFieldSeverity InterruptionField = "severity"
+	// InterruptionFieldTags is a comma separated list of the tags of the
+	// interrupting rule.
+	InterruptionFieldTags InterruptionField = "tags"
+	// InterruptionFieldPhase is the phase of the interrupting rule.
+	InterruptionFieldPhase InterruptionField = "phase"
+	// InterruptionFieldMatchedVar is the first variable matched by the
+	// interrupting rule, e.g. ARGS:id.
+	InterruptionFieldMatchedVar InterruptionField = "matched_var"
+	// InterruptionFieldInboundAnomalyScore is the CRS inbound anomaly score.
+	InterruptionFieldInboundAnomalyScore InterruptionField = "inbound_anomaly_score"
+	// InterruptionFieldOutboundAnomalyScore is the CRS outbound anomaly score.
+	InterruptionFieldOutboundAnomalyScore InterruptionField = "outbound_anomaly_score"
+	// InterruptionFieldParanoiaLevel is the CRS blocking paranoia level.
+	InterruptionFieldParanoiaLevel InterruptionField = "paranoia_level"
+)
+
+// ParseInterruptionFields validates the names of interruption fields.
+func ParseInterruptionFields(names []string) ([]InterruptionField, error) {
+	fields := make([]InterruptionField, 0, len(names))
+	for _, name := range names {
+		switch f := InterruptionField(name); f {
+		case InterruptionFieldMsg, InterruptionFieldSeverity, InterruptionFieldTags,
+			InterruptionFieldPhase, InterruptionFieldMatchedVar, InterruptionFieldInboundAnomalyScore,
+			InterruptionFieldOutboundAnomalyScore, InterruptionFieldParanoiaLevel:
+			fields = append(fields, f)
+		default:
+			return nil, fmt.Errorf("unknown interruption field: %q", name)
+		}
+	}
+	return fields, nil
+}
+
+// exportInterruptionFields exports the configured interruption fields if
+// err is an interruption. It has to run before the transaction is closed.
+func (a *Application) exportInterruptionFields(writer *encoding.ActionWriter, tx types.Transaction, err error) {
+	var interruption ErrInterrupted
+	if len(a.InterruptionFields) == 0 || !errors.As(err, &interruption) {
+		return
+	}
+
+	var rule types.MatchedRule
+	for _, mr := range tx.MatchedRules() {
+		if mr.Rule().ID() == interruption.Interruption.RuleID {
+			rule = mr
+			break
+		}
+	}
+
+	for _, f := range a.InterruptionFields {
+		name := string(f)
+		switch f {
+		case InterruptionFieldInboundAnomalyScore:
+			_ = writer.SetInt64(encoding.VarScopeTransaction, name, txInt(tx, "blocking_inbound_anomaly_score"))
+		case InterruptionFieldOutboundAnomalyScore:
+			_ = writer.SetInt64(encoding.VarScopeTransaction, name, txInt(tx, "blocking_outbound_anomaly_score"))
+		case InterruptionFieldParanoiaLevel:
+			_ = writer.SetInt64(encoding.VarScopeTransaction, name, txInt(tx, "blocking_paranoia_level"))
+		}
+
+		// The remaining fields describe the rule, which is missing if the
+		// interruption was not caused by a rule.
+		if rule == nil {
+			continue
+		}
+		switch f {
+		case InterruptionFieldMsg:
+			_ = writer.SetString(encoding.VarScopeTransaction, name, rule.Message())
+		case InterruptionFieldSeverity:
+			_ = writer.SetString(encoding.VarScopeTransaction, name, rule.Rule().Severity().String())
+		case InterruptionFieldTags:
+			_ = writer.SetString(encoding.VarScopeTransaction, name, strings.Join(rule.Rule().Tags(), ","))
+		case InterruptionFieldPhase:
+			_ = writer.SetString(encoding.VarScopeTransaction, name, phaseToString(rule.Rule().Phase()))
+		case InterruptionFieldMatchedVar:
+			if data := rule.MatchedDatas(); len(data) > 0 {
+				_ = writer.SetString(encoding.VarScopeTransaction, name, matchedVarName(data[0]))
+			}
+		}
+	}
+}
+
+// matchedVarName formats the variable like ModSecurity, e.g. ARGS:id.
+func matchedVarName(md types.MatchData) string {
+	if md.Key() == "" {
+		return md.Variable().Name()
+	}
+	return md.Variable().Name() + ":" + md.Key()
+}
+
+// txInt returns the integer value of a TX variable, or zero if it is not
+// set or not a number.
+func txInt(tx types.Transaction, key string) int64 {
+	txState, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return 0
+	}
+	values := txState.Variables().TX().Get(key)
+	if len(values) == 0 {
+		return 0
+	}
+	v, _ := strconv.ParseInt(values[0], 10, 64)
+	return v
+}
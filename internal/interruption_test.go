@@ -0,0 +1,97 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+func TestParseInterruptionFields(t *testing.T) {
+	fields, err := ParseInterruptionFields([]string{"msg", "paranoia_level"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 2 || fields[0] != InterruptionFieldMsg || fields[1] != InterruptionFieldParanoiaLevel {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+
+	if _, err := ParseInterruptionFields([]string{"msg", "unknown"}); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
+
+func TestApplication_InterruptionFields(t *testing.T) {
+	const directives = `
+SecRuleEngine On
+SecAction "id:10,phase:1,pass,nolog,setvar:tx.blocking_inbound_anomaly_score=7,setvar:tx.blocking_paranoia_level=2"
+SecRule ARGS:q "@contains attack" "id:11,phase:1,deny,status:403,msg:'Attack detected',severity:CRITICAL,tag:attack-sqli,tag:paranoia-level/1"
+`
+
+	tests := []struct {
+		name   string
+		fields []InterruptionField
+		want   map[string]any
+	}{
+		{
+			name: "disabled",
+			want: map[string]any{},
+		},
+		{
+			name: "all",
+			fields: []InterruptionField{
+				InterruptionFieldMsg, InterruptionFieldSeverity, InterruptionFieldTags, InterruptionFieldPhase,
+				InterruptionFieldMatchedVar, InterruptionFieldInboundAnomalyScore,
+				InterruptionFieldOutboundAnomalyScore, InterruptionFieldParanoiaLevel,
+			},
+			want: map[string]any{
+				"msg":                    "Attack detected",
+				"severity":               "critical",
+				"tags":                   "attack-sqli,paranoia-level/1",
+				"phase":                  "request-headers",
+				"matched_var":            "ARGS:q",
+				"inbound_anomaly_score":  int64(7),
+				"outbound_anomaly_score": int64(0),
+				"paranoia_level":         int64(2),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgentWith(t, directives, func(c *AppConfig) {
+				c.InterruptionFields = tt.fields
+			}, "default")
+
+			msg := buildMessage(t, "coraza-req", func(kw *encoding.KVWriter) error {
+				if err := kw.SetString("app", "default"); err != nil {
+					return err
+				}
+				if err := kw.SetString("path", "/search"); err != nil {
+					return err
+				}
+				return kw.SetString("query", "q=attack")
+			})
+			aw := encoding.NewActionWriter(make([]byte, 4096), 0)
+			a.HandleSPOE(context.Background(), aw, msg)
+
+			vars := actionVars(t, aw)
+			if vars["ruleid"] != int64(11) {
+				t.Fatalf("expected interruption by rule 11, got %v", vars)
+			}
+			for name, want := range tt.want {
+				if got := vars[name]; got != want {
+					t.Errorf("expected %s %v, got %v", name, want, got)
+				}
+			}
+			if len(tt.fields) == 0 {
+				if _, ok := vars["msg"]; ok {
+					t.Error("expected msg not to be exported")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+// kvReader iterates over the KV entries of a SPOE message.
+// It is implemented by *encoding.KVScanner.
+type kvReader interface {
+	Next(e *encoding.KVEntry) bool
+}
+
+// replayKV returns entries that were already read from a message before
+// continuing with the remaining ones. The buffered entries reference the
+// frame buffer and must only be used while the frame is being handled.
+type replayKV struct {
+	entries []*encoding.KVEntry
+	pos     int
+	next    kvReader
+}
+
+func (r *replayKV) Next(e *encoding.KVEntry) bool {
+	if r.pos < len(r.entries) {
+		*e = *r.entries[r.pos]
+		r.pos++
+		return true
+	}
+	return r.next.Next(e)
+}
+
+// bufferAll reads all remaining entries into the buffer, so they can be
+// inspected before being replayed.
+func (r *replayKV) bufferAll() {
+	for {
+		k := encoding.AcquireKVEntry()
+		if !r.next.Next(k) {
+			encoding.ReleaseKVEntry(k)
+			return
+		}
+		r.entries = append(r.entries, k)
+	}
+}
+
+// release returns all buffered entries to the pool.
+func (r *replayKV) release() {
+	for _, e := range r.entries {
+		encoding.ReleaseKVEntry(e)
+	}
+	r.entries = nil
+}
+
+// kvAddr returns the address of an entry. Unlike KVEntry.ValueAddr, it
+// returns an error instead of panicking if the entry is not an address.
+func kvAddr(k *encoding.KVEntry) (netip.Addr, error) {
+	switch k.Type() {
+	case encoding.DataTypeIPV4, encoding.DataTypeIPV6:
+		if addr, ok := netip.AddrFromSlice(k.ValueBytes()); ok {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("%s is not an address", k.NameBytes())
+}
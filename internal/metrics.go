@@ -1,16 +1,101 @@
 package internal
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+const (
+	outcomePass        = "pass"
+	outcomeInterrupted = "interrupted"
+	outcomeError       = "error"
+)
+
 var (
-	handleSPOEDuration = promauto.NewHistogram(
+	handleSPOEDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "coraza_handle_spoe_duration_seconds",
 			Help:    "Duration of Coraza SPOE handling",
 			Buckets: prometheus.DefBuckets,
 		},
+		[]string{"app", "message", "outcome"},
+	)
+
+	messagesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coraza_messages_total",
+			Help: "Number of handled SPOE messages by outcome",
+		},
+		[]string{"app", "message", "outcome"},
+	)
+
+	interruptionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coraza_interruptions_total",
+			Help: "Number of messages interrupted by the WAF by action",
+		},
+		[]string{"app", "message", "action"},
+	)
+
+	errorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coraza_errors_total",
+			Help: "Number of messages which could not be processed by error reason",
+		},
+		[]string{"app", "message", "reason"},
+	)
+
+	defaultApplicationFallbacks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coraza_default_application_fallbacks_total",
+			Help: "Number of messages processed by the default application because the app was unknown or missing",
+		},
+		[]string{"message"},
+	)
+
+	transactionCacheEntries = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "coraza_transaction_cache_entries",
+			Help: "Number of transactions cached for response processing",
+		},
+		[]string{"app"},
+	)
+
+	truncatedBodies = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coraza_truncated_bodies_total",
+			Help: "Number of request and response bodies which were shorter than announced",
+		},
+		[]string{"app", "direction"},
+	)
+
+	retiredGenerations = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "coraza_retired_generations",
+			Help: "Number of application generations replaced by reloads which still hold transactions",
+		},
+	)
+
+	crossGenerationLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coraza_cross_generation_lookups_total",
+			Help: "Number of messages continuing a transaction of an application generation replaced by a reload",
+		},
+		[]string{"app", "message"},
+	)
+
+	detectOnlyInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "coraza_detect_only_in_flight",
+			Help: "Number of detect-only response evaluations running in the background",
+		},
+		[]string{"app"},
 	)
 )
+
+func observeMessage(app, message, outcome string, d time.Duration) {
+	messagesTotal.WithLabelValues(app, message, outcome).Inc()
+	handleSPOEDuration.WithLabelValues(app, message, outcome).Observe(d.Seconds())
+}
@@ -0,0 +1,114 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+// Route maps a request to an application by its host and, optionally,
+// its destination port. Routes are only consulted when HAProxy does not
+// send an app name.
+type Route struct {
+	// Host is matched case-insensitively against the request host. A
+	// leading "*." matches any subdomain, but not the domain itself.
+	Host string
+	// HostRegex is matched against the lowercased request host. It is
+	// ignored if Host is set.
+	HostRegex *regexp.Regexp
+	// Port restricts the route to a destination port. Zero matches any port.
+	Port int64
+	// Application is the name of the application to use on a match.
+	Application string
+}
+
+func (r Route) matches(host string, port int64) bool {
+	if r.Port != 0 && r.Port != port {
+		return false
+	}
+
+	switch {
+	case r.Host != "":
+		pattern := strings.ToLower(r.Host)
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+		}
+		return host == pattern
+	case r.HostRegex != nil:
+		return r.HostRegex.MatchString(host)
+	default:
+		// port-only route
+		return true
+	}
+}
+
+// resolveRoute returns the application name of the first route matching
+// the given host and port.
+func resolveRoute(routes []Route, host string, port int64) (string, bool) {
+	host = normalizeHost(host)
+	for _, r := range routes {
+		if r.matches(host, port) {
+			return r.Application, true
+		}
+	}
+	return "", false
+}
+
+// normalizeHost lowercases the host and strips an optional port and a
+// trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	return strings.ToLower(host)
+}
+
+// routeInfo collects the routing relevant values of a request message.
+type routeInfo struct {
+	hostArg       string
+	headers       []byte
+	headersFormat HeadersFormat
+	sni           string
+	port          int64
+}
+
+func (ri *routeInfo) collect(k *encoding.KVEntry) {
+	switch name := string(k.NameBytes()); name {
+	case "host":
+		ri.hostArg = string(k.ValueBytes())
+	case "sni":
+		ri.sni = string(k.ValueBytes())
+	case "dst-port":
+		ri.port = k.ValueInt()
+	case "headers":
+		ri.headers = k.ValueBytes()
+	case "headers-format":
+		ri.headersFormat = HeadersFormat(k.ValueBytes())
+	}
+}
+
+// host returns the most specific host known for the request: an explicit
+// host argument, then the Host header and finally the TLS SNI.
+func (ri *routeInfo) host() string {
+	if ri.hostArg != "" {
+		return ri.hostArg
+	}
+
+	var header string
+	if format, err := parseHeadersFormat(string(ri.headersFormat)); err == nil {
+		// Invalid headers are reported by the application.
+		_ = readHeaders(ri.headers, format, func(string, string) {}, func(value string) {
+			header = value
+		})
+	}
+	if header != "" {
+		return header
+	}
+	return ri.sni
+}
@@ -0,0 +1,43 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestResolveRoute(t *testing.T) {
+	routes := []Route{
+		{Host: "api.example.com", Application: "api"},
+		{Host: "*.example.com", Port: 8443, Application: "tls"},
+		{Host: "*.example.com", Application: "wildcard"},
+		{HostRegex: regexp.MustCompile(`^shop-[0-9]+\.example\.org$`), Application: "shop"},
+		{Port: 9000, Application: "port"},
+	}
+
+	tests := []struct {
+		host string
+		port int64
+		want string
+	}{
+		{host: "api.example.com", want: "api"},
+		{host: "API.Example.com:8080", want: "api"},
+		{host: "api.example.com.", want: "api"},
+		{host: "www.example.com", port: 8443, want: "tls"},
+		{host: "www.example.com", port: 443, want: "wildcard"},
+		{host: "example.com", want: ""},
+		{host: "shop-12.example.org", want: "shop"},
+		{host: "shop-x.example.org", want: ""},
+		{host: "other.test", port: 9000, want: "port"},
+		{host: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		got, ok := resolveRoute(routes, tt.host, tt.port)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("resolveRoute(%q, %d) = %q, %v; want %q", tt.host, tt.port, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package internal
+
+import (
+	"sort"
+	"time"
+)
+
+// ApplicationStatus describes a loaded application.
+type ApplicationStatus struct {
+	Name string `json:"name"`
+	// DirectivesHash is the hex encoded SHA-256 of the directives and the
+	// files they include, ConfigHash identifies the whole configuration.
+	DirectivesHash     string    `json:"directives_hash"`
+	ConfigHash         string    `json:"config_hash,omitempty"`
+	LoadedAt           time.Time `json:"loaded_at"`
+	CachedTransactions int       `json:"cached_transactions"`
+	Default            bool      `json:"default"`
+}
+
+// Status describes the current applications and the number of retired
+// generations.
+type Status struct {
+	Applications       []ApplicationStatus `json:"applications"`
+	RetiredGenerations int                 `json:"retired_generations"`
+}
+
+// Status returns the state of the agent, the applications are sorted by
+// name.
+func (a *Agent) Status() Status {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	status := Status{
+		Applications:       make([]ApplicationStatus, 0, len(a.Applications)),
+		RetiredGenerations: len(a.generations),
+	}
+	for name, app := range a.Applications {
+		status.Applications = append(status.Applications, ApplicationStatus{
+			Name:               name,
+			DirectivesHash:     app.DirectivesHash,
+			ConfigHash:         app.ConfigHash,
+			LoadedAt:           app.loadedAt,
+			CachedTransactions: app.cache.Len(),
+			Default:            app == a.DefaultApplication,
+		})
+	}
+	sort.Slice(status.Applications, func(i, j int) bool {
+		return status.Applications[i].Name < status.Applications[j].Name
+	})
+	return status
+}
@@ -97,10 +97,48 @@ func (c *ttlCache) Get(key any) (any, bool) {
 	return value, true
 }
 
-func (c *ttlCache) Remove(key any) {
+// Len returns the number of entries, including expired ones that were
+// not evicted yet.
+func (c *ttlCache) Len() int {
 	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// maxExpiry returns the latest expiry of the entries, or the zero time if
+// the cache is empty.
+func (c *ttlCache) maxExpiry() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var latest time.Time
+	for _, e := range c.entries {
+		if e.expiresAt.After(latest) {
+			latest = e.expiresAt
+		}
+	}
+	return latest
+}
+
+// Remove deletes the entry and reports whether it was still cached.
+func (c *ttlCache) Remove(key any) bool {
+	c.mu.Lock()
+	_, ok := c.entries[key]
 	delete(c.entries, key)
 	c.mu.Unlock()
+	return ok
+}
+
+// flush removes all entries and invokes the eviction callback for each of
+// them synchronously.
+func (c *ttlCache) flush() {
+	c.mu.Lock()
+	entries := c.entries
+	c.entries = make(map[any]*ttlEntry)
+	c.mu.Unlock()
+
+	for k, e := range entries {
+		c.evictionCallback(k, e.value)
+	}
 }
 
 func (c *ttlCache) stop() {
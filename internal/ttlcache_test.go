@@ -77,6 +77,27 @@ func TestTTLCache_Expiry(t *testing.T) {
 	}
 }
 
+func TestTTLCache_MaxExpiry(t *testing.T) {
+	c := newTTLCache(time.Minute, func(_, _ any) {})
+	defer c.stop()
+
+	if got := c.maxExpiry(); !got.IsZero() {
+		t.Fatalf("expected zero expiry of an empty cache, got %v", got)
+	}
+
+	before := time.Now()
+	c.SetWithExpiration("short", "value", time.Second)
+	c.SetWithExpiration("long", "value", time.Hour)
+	if got := c.maxExpiry(); got.Before(before.Add(time.Hour)) || got.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expected expiry of the longest entry, got %v", got)
+	}
+
+	c.Remove("long")
+	if got := c.maxExpiry(); got.After(time.Now().Add(time.Second)) {
+		t.Errorf("expected expiry of the remaining entry, got %v", got)
+	}
+}
+
 func TestTTLCache_EvictionCallback(t *testing.T) {
 	var mu sync.Mutex
 	evicted := map[any]any{}
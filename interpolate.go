@@ -0,0 +1,174 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// interpolator expands references in the scalars of the config:
+//
+//   - ${VAR} is replaced by the environment variable VAR, which has to be set.
+//   - ${VAR:-default} is replaced by default if VAR is unset or empty.
+//   - ${file:/path} is replaced by the content of the file without trailing
+//     line breaks. Relative paths are relative to the config file.
+//   - $${ is replaced by a literal ${.
+type interpolator struct {
+	// secrets are the values read from files, they are redacted from the
+	// config served by the admin API.
+	secrets []string
+}
+
+// expandNode expands the scalars of the node and its children in place.
+func (in *interpolator) expandNode(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+		value, err := in.expand(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", referenceLine(node, err), err)
+		}
+		node.Value = value
+		if node.Style == 0 {
+			// let the expanded value resolve to its type, e.g. an integer
+			node.Tag = ""
+		}
+		return nil
+	}
+	for _, child := range node.Content {
+		if err := in.expandNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referenceError is an invalid reference at an offset of a scalar.
+type referenceError struct {
+	offset int
+	err    error
+}
+
+func (e referenceError) Error() string {
+	return e.err.Error()
+}
+
+// referenceLine returns the line of the file with the reference of the
+// error. Lines folded into a plain or folded scalar are not counted.
+func referenceLine(node *yaml.Node, err error) int {
+	line := node.Line
+	refErr, ok := err.(referenceError)
+	if !ok {
+		return line
+	}
+	if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		// the content starts below the indicator
+		line++
+	}
+	return line + strings.Count(node.Value[:refErr.offset], "\n")
+}
+
+func (in *interpolator) expand(s string) (string, error) {
+	var sb strings.Builder
+	for pos := 0; ; {
+		i := strings.Index(s[pos:], "${")
+		if i < 0 {
+			sb.WriteString(s[pos:])
+			return sb.String(), nil
+		}
+		i += pos
+		if i > 0 && s[i-1] == '$' {
+			// escaped
+			sb.WriteString(s[pos : i-1])
+			sb.WriteString("${")
+			pos = i + 2
+			continue
+		}
+		sb.WriteString(s[pos:i])
+
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			ref, _, _ := strings.Cut(s[i:], "\n")
+			return "", referenceError{i, fmt.Errorf("unterminated reference %q, write $${ for a literal ${", ref)}
+		}
+		value, err := in.resolve(s[i+2 : i+end])
+		if err != nil {
+			return "", referenceError{i, err}
+		}
+		sb.WriteString(value)
+		pos = i + end + 1
+	}
+}
+
+func (in *interpolator) resolve(ref string) (string, error) {
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		if path == "" {
+			return "", fmt.Errorf("missing path in ${%s}", ref)
+		}
+		data, err := os.ReadFile(resolveConfigPath(path))
+		if err != nil {
+			return "", fmt.Errorf("reading ${%s}: %v", ref, err)
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		if value != "" {
+			in.secrets = append(in.secrets, value)
+		}
+		return value, nil
+	}
+
+	name, def, hasDefault := strings.Cut(ref, ":-")
+	if !isEnvName(name) {
+		return "", fmt.Errorf("invalid variable name in ${%s}, write $${ for a literal ${", ref)
+	}
+	value, ok := os.LookupEnv(name)
+	if hasDefault && value == "" {
+		return def, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("undefined variable %s", name)
+	}
+	return value, nil
+}
+
+func isEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// minSecretLength is the length from which a secret is also redacted from
+// values it is only part of. Shorter secrets, like a port or a flag, would
+// redact unrelated values.
+const minSecretLength = 8
+
+// redactSecrets replaces the scalars of the node which are a secret or
+// contain a secret of at least minSecretLength bytes.
+func redactSecrets(node *yaml.Node, secrets []string, redacted string) {
+	if node.Kind == yaml.ScalarNode {
+		for _, secret := range secrets {
+			if node.Value == secret || (len(secret) >= minSecretLength && strings.Contains(node.Value, secret)) {
+				node.Value = redacted
+				node.Tag = "!!str"
+				return
+			}
+		}
+		return
+	}
+	for _, child := range node.Content {
+		redactSecrets(child, secrets, redacted)
+	}
+}
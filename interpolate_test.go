@@ -0,0 +1,226 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestInterpolator_Expand(t *testing.T) {
+	dir := t.TempDir()
+	setConfigPath(t, dir)
+	writeFiles(t, dir, map[string]string{
+		"secrets/token": "s3cr3t-token\n",
+		"empty":         "\n",
+	})
+	t.Setenv("CORAZA_HOST", "waf.example.com")
+	t.Setenv("CORAZA_EMPTY", "")
+	os.Unsetenv("CORAZA_UNSET")
+
+	tests := []struct {
+		name        string
+		in          string
+		want        string
+		wantSecrets []string
+		wantErr     bool
+	}{
+		{name: "plain", in: "SecRuleEngine On", want: "SecRuleEngine On"},
+		{name: "variable", in: "${CORAZA_HOST}", want: "waf.example.com"},
+		{name: "embedded", in: "https://${CORAZA_HOST}:${CORAZA_EMPTY}/", want: "https://waf.example.com:/"},
+		{name: "escaped", in: "$${CORAZA_HOST}", want: "${CORAZA_HOST}"},
+		{name: "escaped and expanded", in: "$${x} ${CORAZA_HOST}", want: "${x} waf.example.com"},
+		{name: "dollar without brace", in: "$CORAZA_HOST $", want: "$CORAZA_HOST $"},
+		{name: "default of unset", in: "${CORAZA_UNSET:-info}", want: "info"},
+		{name: "default of empty", in: "${CORAZA_EMPTY:-info}", want: "info"},
+		{name: "default of set", in: "${CORAZA_HOST:-localhost}", want: "waf.example.com"},
+		{name: "empty default", in: "${CORAZA_UNSET:-}", want: ""},
+		{name: "empty without default", in: "${CORAZA_EMPTY}", want: ""},
+		{name: "undefined", in: "${CORAZA_UNSET}", wantErr: true},
+		{name: "invalid name", in: "${CORAZA-HOST}", wantErr: true},
+		{name: "empty name", in: "${}", wantErr: true},
+		{name: "unterminated", in: "${CORAZA_HOST", wantErr: true},
+		{
+			name:        "relative file",
+			in:          "Bearer ${file:secrets/token}",
+			want:        "Bearer s3cr3t-token",
+			wantSecrets: []string{"s3cr3t-token"},
+		},
+		{
+			name:        "absolute file",
+			in:          "${file:" + filepath.Join(dir, "secrets/token") + "}",
+			want:        "s3cr3t-token",
+			wantSecrets: []string{"s3cr3t-token"},
+		},
+		{name: "empty file", in: "${file:empty}", want: ""},
+		{name: "missing path", in: "${file:}", wantErr: true},
+		{name: "missing file", in: "${file:missing}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in interpolator
+			got, err := in.expand(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+			if !slices.Equal(in.secrets, tt.wantSecrets) {
+				t.Errorf("expected secrets %q, got %q", tt.wantSecrets, in.secrets)
+			}
+		})
+	}
+}
+
+func TestInterpolator_ExpandNode(t *testing.T) {
+	t.Setenv("CORAZA_TTL", "60000")
+	t.Setenv("CORAZA_CHECK", "true")
+
+	var root yaml.Node
+	err := yaml.Unmarshal([]byte(`
+transaction_ttl_ms: ${CORAZA_TTL}
+response_check: ${CORAZA_CHECK}
+name: "${CORAZA_TTL}"
+list:
+  - ${CORAZA_TTL}
+`), &root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in interpolator
+	if err := in.expandNode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		TransactionTTLMS int      `yaml:"transaction_ttl_ms"`
+		ResponseCheck    bool     `yaml:"response_check"`
+		Name             string   `yaml:"name"`
+		List             []string `yaml:"list"`
+	}
+	if err := root.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.TransactionTTLMS != 60000 || !got.ResponseCheck || got.Name != "60000" || !slices.Equal(got.List, []string{"60000"}) {
+		t.Errorf("unexpected expanded values %+v", got)
+	}
+
+	t.Setenv("CORAZA_TTL", "")
+	os.Unsetenv("CORAZA_TTL")
+	root = yaml.Node{}
+	if err := yaml.Unmarshal([]byte("\nname: ok\nttl: ${CORAZA_TTL}\n"), &root); err != nil {
+		t.Fatal(err)
+	}
+	err = in.expandNode(&root)
+	if err == nil || err.Error() != "line 3: undefined variable CORAZA_TTL" {
+		t.Errorf("expected undefined variable error with line, got %v", err)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	var root yaml.Node
+	err := yaml.Unmarshal([]byte(`
+token: s3cr3t-token
+header: Bearer s3cr3t-token
+port: 1
+enabled: true
+path: /var/log/app1.log
+other: public
+`), &root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redactSecrets(&root, []string{"s3cr3t-token", "1", "true"}, "[redacted]")
+
+	var got map[string]string
+	if err := root.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"token":   "[redacted]",
+		"header":  "[redacted]",
+		"port":    "[redacted]",
+		"enabled": "[redacted]",
+		// short secrets only redact whole values
+		"path":  "/var/log/app1.log",
+		"other": "public",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, got[key])
+		}
+	}
+}
+
+func TestInterpolator_ExpandNodeErrors(t *testing.T) {
+	os.Unsetenv("CORAZA_UNSET")
+
+	tests := []struct {
+		name     string
+		yaml     string
+		want     string
+		wantErr  string
+		wantLine string
+	}{
+		{
+			name:     "plain",
+			yaml:     "name: a\nlog_level: ${CORAZA_UNSET}\n",
+			wantErr:  "undefined variable CORAZA_UNSET",
+			wantLine: "line 2:",
+		},
+		{
+			name:     "literal block",
+			yaml:     "directives: |\n  SecRuleEngine On\n\n  SecRule ARGS \"@rx \\${jndi:\" \"id:1,deny\"\n",
+			wantErr:  `unterminated reference "${jndi:\" \"id:1,deny\"", write $${ for a literal ${`,
+			wantLine: "line 4:",
+		},
+		{
+			name:     "invalid name in block",
+			yaml:     "directives: |-\n  SecRuleEngine On\n  SecRule ARGS \"@rx ${jndi:.*}\" \"id:1,deny\"\n",
+			wantErr:  "invalid variable name in ${jndi:.*}, write $${ for a literal ${",
+			wantLine: "line 3:",
+		},
+		{
+			name: "escaped",
+			yaml: "directives: |\n  SecRule ARGS \"@rx \\$${jndi:\" \"id:1,deny\"\n",
+			want: "SecRule ARGS \"@rx \\${jndi:\" \"id:1,deny\"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root yaml.Node
+			if err := yaml.Unmarshal([]byte(tt.yaml), &root); err != nil {
+				t.Fatal(err)
+			}
+			var in interpolator
+			err := in.expandNode(&root)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := root.Content[0].Content[1].Value; got != tt.want {
+					t.Errorf("expected %q, got %q", tt.want, got)
+				}
+				return
+			}
+			if want := tt.wantLine + " " + tt.wantErr; err == nil || err.Error() != want {
+				t.Errorf("expected error %q, got %v", want, err)
+			}
+		})
+	}
+}
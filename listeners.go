@@ -0,0 +1,312 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/corazawaf/coraza-spoa/internal"
+)
+
+// listenerSet keeps one listener per bind address and serves the agent on
+// each of them.
+type listenerSet struct {
+	ctx   context.Context
+	agent *internal.Agent
+
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+	// sockets holds the paths of the unix sockets created for bind
+	// addresses, which get the configured permissions.
+	sockets map[string]string
+	// inherited holds the sockets passed by systemd socket activation
+	// until they are claimed by a bind address.
+	inherited []net.Listener
+}
+
+func newListenerSet(ctx context.Context, a *internal.Agent) (*listenerSet, error) {
+	inherited, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	return &listenerSet{
+		ctx:       ctx,
+		agent:     a,
+		listeners: make(map[string]net.Listener),
+		sockets:   make(map[string]string),
+		inherited: inherited,
+	}, nil
+}
+
+// socketPermissions is applied to the unix sockets created by coraza-spoa.
+// Sockets passed by systemd are left as configured in the socket unit.
+type socketPermissions struct {
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+func (p socketPermissions) apply(path string) error {
+	if p.mode != 0 {
+		if err := os.Chmod(path, p.mode); err != nil {
+			return err
+		}
+	}
+	if p.uid != -1 || p.gid != -1 {
+		if err := os.Chown(path, p.uid, p.gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update opens listeners for new bind addresses and closes the ones which
+// are not configured anymore. If a listener cannot be opened, the current
+// listeners are kept as they are. A bind address matching a socket passed
+// by systemd uses that socket instead of opening a new one.
+func (ls *listenerSet) update(binds []string, perm socketPermissions) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	opened := make(map[string]net.Listener)
+	sockets := make(map[string]string)
+	claimed := make(map[net.Listener]struct{})
+	for _, bind := range binds {
+		if _, ok := ls.listeners[bind]; ok {
+			// Permissions might have changed on reload.
+			if path, ok := ls.sockets[bind]; ok {
+				if err := perm.apply(path); err != nil {
+					globalLogger.Warn().Err(err).Str("bind", bind).Msg("Failed setting socket permissions")
+				}
+			}
+			continue
+		}
+		if _, ok := opened[bind]; ok {
+			continue
+		}
+
+		network, address := networkAddressFromBind(bind)
+		if l := ls.claimInherited(network, address, claimed); l != nil {
+			opened[bind] = l
+			continue
+		}
+
+		l, err := listen(ls.ctx, network, address, perm)
+		if err != nil {
+			for _, l := range opened {
+				if _, ok := claimed[l]; !ok {
+					l.Close()
+				}
+			}
+			return fmt.Errorf("opening listener %q: %w", bind, err)
+		}
+		opened[bind] = l
+		if network == "unix" {
+			sockets[bind] = address
+		}
+	}
+
+	// Sockets passed by systemd but not configured would never be served.
+	for _, l := range ls.inherited {
+		if _, ok := claimed[l]; ok {
+			continue
+		}
+		globalLogger.Warn().Str("addr", l.Addr().String()).Msg("Closing socket passed by systemd which matches no bind address")
+		l.Close()
+	}
+	ls.inherited = nil
+
+	wanted := make(map[string]struct{}, len(binds))
+	for _, bind := range binds {
+		wanted[bind] = struct{}{}
+	}
+	for bind, l := range ls.listeners {
+		if _, ok := wanted[bind]; ok {
+			continue
+		}
+		globalLogger.Info().Str("bind", bind).Msg("Closing listener")
+		if err := ls.agent.CloseListener(l); err != nil {
+			globalLogger.Warn().Err(err).Str("bind", bind).Msg("Failed closing listener")
+		}
+		delete(ls.listeners, bind)
+		delete(ls.sockets, bind)
+	}
+
+	for bind, path := range sockets {
+		ls.sockets[bind] = path
+	}
+	for bind, l := range opened {
+		ls.listeners[bind] = l
+		go func() {
+			globalLogger.Info().Str("bind", bind).Msg("Listening")
+			if err := ls.agent.Serve(l); err != nil && ls.serving(bind, l) {
+				globalLogger.Fatal().Err(err).Str("bind", bind).Msg("Listener closed")
+			}
+		}()
+	}
+
+	return nil
+}
+
+// serving reports if l is still the listener of the bind address. A
+// listener closed by an update before it was served is not.
+func (ls *listenerSet) serving(bind string, l net.Listener) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.listeners[bind] == l
+}
+
+// claimInherited returns the socket passed by systemd for the address,
+// if any.
+func (ls *listenerSet) claimInherited(network, address string, claimed map[net.Listener]struct{}) net.Listener {
+	for _, l := range ls.inherited {
+		if _, ok := claimed[l]; ok {
+			continue
+		}
+		if listenerMatches(l, network, address) {
+			claimed[l] = struct{}{}
+			return l
+		}
+	}
+	return nil
+}
+
+// listen opens a listener for the address. For unix sockets, a stale socket
+// file left by a previous process is removed and the permissions are set.
+func listen(ctx context.Context, network, address string, perm socketPermissions) (net.Listener, error) {
+	if network != "unix" {
+		return (&net.ListenConfig{}).Listen(ctx, network, address)
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	l, err := (&net.ListenConfig{}).Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := perm.apply(address); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("setting socket permissions: %w", err)
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file at path if no process accepts
+// connections on it anymore.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	// Other errors, like a denied permission or a timeout, do not tell
+	// whether the socket is still in use.
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("checking socket %s: %w", path, err)
+	}
+	globalLogger.Info().Str("path", path).Msg("Removing stale socket")
+	return os.Remove(path)
+}
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// see sd_listen_fds(3).
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// The variables must not be inherited by child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("using socket %q passed by systemd: %w", name, err)
+		}
+		globalLogger.Debug().Str("name", name).Str("addr", l.Addr().String()).Msg("Received socket from systemd")
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenerMatches reports whether l listens on the network address.
+func listenerMatches(l net.Listener, network, address string) bool {
+	switch addr := l.Addr().(type) {
+	case *net.UnixAddr:
+		return network == "unix" && addr.Name == address
+	case *net.TCPAddr:
+		if network != "tcp" {
+			return false
+		}
+		want, err := net.ResolveTCPAddr(network, address)
+		if err != nil || want.Port != addr.Port {
+			return false
+		}
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return addr.IP.IsUnspecified()
+		}
+		return want.IP.Equal(addr.IP)
+	default:
+		return false
+	}
+}
+
+// networkAddressFromBind supports plain host:port addresses as well as
+// tcp:// and unix:// URLs.
+func networkAddressFromBind(bind string) (network string, address string) {
+	bindUrl, err := url.Parse(bind)
+	if err == nil {
+		switch bindUrl.Scheme {
+		case "unix":
+			return bindUrl.Scheme, bindUrl.Path
+		case "tcp":
+			return bindUrl.Scheme, bindUrl.Host
+		}
+	}
+
+	return "tcp", bind
+}
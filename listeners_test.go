@@ -0,0 +1,348 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/corazawaf/coraza-spoa/internal"
+)
+
+func newTestListenerSet(t *testing.T) *listenerSet {
+	t.Helper()
+
+	a := &internal.Agent{
+		Context: context.Background(),
+		Logger:  zerolog.Nop(),
+	}
+	ls, err := newListenerSet(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = a.Shutdown(ctx)
+	})
+	return ls
+}
+
+func (ls *listenerSet) binds() []string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var binds []string
+	for bind := range ls.listeners {
+		binds = append(binds, bind)
+	}
+	slices.Sort(binds)
+	return binds
+}
+
+func socketExists(path string) bool {
+	_, err := os.Lstat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+func TestListenerSet_Update(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.sock")
+	b := filepath.Join(dir, "b.sock")
+	c := filepath.Join(dir, "c.sock")
+	bindA, bindB, bindC := "unix://"+a, "unix://"+b, "unix://"+c
+	perm := socketPermissions{uid: -1, gid: -1}
+
+	ls := newTestListenerSet(t)
+	if err := ls.update([]string{bindA, bindB}, perm); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ls.binds(), []string{bindA, bindB}; !slices.Equal(got, want) {
+		t.Fatalf("expected listeners %v, got %v", want, got)
+	}
+	listenerA := ls.listeners[bindA]
+
+	// b is closed, c is opened and a is kept
+	if err := ls.update([]string{bindA, bindC}, perm); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ls.binds(), []string{bindA, bindC}; !slices.Equal(got, want) {
+		t.Fatalf("expected listeners %v, got %v", want, got)
+	}
+	if ls.listeners[bindA] != listenerA {
+		t.Error("expected the listener of a to be kept")
+	}
+	if socketExists(b) {
+		t.Error("expected the socket of b to be removed")
+	}
+
+	// b opens before the missing directory fails, and must be closed again
+	missing := "unix://" + filepath.Join(dir, "missing", "d.sock")
+	if err := ls.update([]string{bindA, bindB, missing}, perm); err == nil {
+		t.Fatal("expected an error for a socket in a missing directory")
+	}
+	if got, want := ls.binds(), []string{bindA, bindC}; !slices.Equal(got, want) {
+		t.Errorf("expected listeners %v to be kept, got %v", want, got)
+	}
+	if socketExists(b) {
+		t.Error("expected the socket of b to be closed after the failed update")
+	}
+	for _, path := range []string{a, c} {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Errorf("expected %s to accept connections: %v", path, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("missing", func(t *testing.T) {
+		if err := removeStaleSocket(filepath.Join(dir, "missing.sock")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		path := filepath.Join(dir, "stale.sock")
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// leave the socket file behind like a crashed process
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+
+		if err := removeStaleSocket(path); err != nil {
+			t.Fatal(err)
+		}
+		if socketExists(path) {
+			t.Error("expected the stale socket to be removed")
+		}
+	})
+
+	t.Run("in use", func(t *testing.T) {
+		path := filepath.Join(dir, "used.sock")
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		if err := removeStaleSocket(path); err == nil {
+			t.Fatal("expected an error for a socket in use")
+		}
+		if !socketExists(path) {
+			t.Error("expected the socket in use to be kept")
+		}
+	})
+
+	t.Run("not a socket", func(t *testing.T) {
+		path := filepath.Join(dir, "file")
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := removeStaleSocket(path); err == nil {
+			t.Fatal("expected an error for a regular file")
+		}
+		if !socketExists(path) {
+			t.Error("expected the file to be kept")
+		}
+	})
+}
+
+// addrListener is a listener which only has an address.
+type addrListener struct {
+	net.Listener
+	addr net.Addr
+}
+
+func (l addrListener) Addr() net.Addr {
+	return l.addr
+}
+
+func TestListenerMatches(t *testing.T) {
+	tcp := func(ip string, port int) net.Listener {
+		return addrListener{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: port}}
+	}
+	unix := addrListener{addr: &net.UnixAddr{Name: "/run/coraza.sock", Net: "unix"}}
+
+	tests := []struct {
+		name    string
+		l       net.Listener
+		network string
+		address string
+		want    bool
+	}{
+		{name: "tcp", l: tcp("127.0.0.1", 9000), network: "tcp", address: "127.0.0.1:9000", want: true},
+		{name: "tcp other port", l: tcp("127.0.0.1", 9000), network: "tcp", address: "127.0.0.1:9001"},
+		{name: "tcp other ip", l: tcp("127.0.0.1", 9000), network: "tcp", address: "127.0.0.2:9000"},
+		{name: "tcp any address", l: tcp("::", 9000), network: "tcp", address: ":9000", want: true},
+		{name: "tcp unspecified ip", l: tcp("0.0.0.0", 9000), network: "tcp", address: "0.0.0.0:9000", want: true},
+		{name: "tcp specific ip on any address", l: tcp("::", 9000), network: "tcp", address: "127.0.0.1:9000"},
+		{name: "tcp invalid address", l: tcp("127.0.0.1", 9000), network: "tcp", address: "invalid"},
+		{name: "tcp for unix", l: tcp("127.0.0.1", 9000), network: "unix", address: "/run/coraza.sock"},
+		{name: "unix", l: unix, network: "unix", address: "/run/coraza.sock", want: true},
+		{name: "unix other path", l: unix, network: "unix", address: "/run/other.sock"},
+		{name: "unix for tcp", l: unix, network: "tcp", address: "127.0.0.1:9000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listenerMatches(tt.l, tt.network, tt.address); got != tt.want {
+				t.Errorf("listenerMatches(%v, %s, %s) = %v, want %v", tt.l.Addr(), tt.network, tt.address, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string
+		fds  string
+	}{
+		{name: "not activated"},
+		{name: "other process", pid: "1", fds: "1"},
+		{name: "no sockets", pid: strconv.Itoa(os.Getpid()), fds: "0"},
+		{name: "invalid count", pid: strconv.Itoa(os.Getpid()), fds: "many"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+
+			listeners, err := systemdListeners()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(listeners) != 0 {
+				t.Errorf("expected no listeners, got %d", len(listeners))
+			}
+		})
+	}
+}
+
+func TestLookupID(t *testing.T) {
+	names := map[string]string{"haproxy": "99", "broken": "not-a-number"}
+	lookup := func(name string) (string, error) {
+		if id, ok := names[name]; ok {
+			return id, nil
+		}
+		return "", fmt.Errorf("unknown name %s", name)
+	}
+
+	tests := []struct {
+		name    string
+		s       string
+		want    int
+		wantErr bool
+	}{
+		{name: "numeric", s: "1000", want: 1000},
+		{name: "name", s: "haproxy", want: 99},
+		{name: "unknown name", s: "nobody", wantErr: true},
+		{name: "invalid id", s: "broken", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupID(tt.s, lookup)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfig_SocketPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config
+		want    socketPermissions
+		wantErr bool
+	}{
+		{
+			name: "unset",
+			want: socketPermissions{uid: -1, gid: -1},
+		},
+		{
+			name: "mode",
+			cfg:  config{BindMode: "0660"},
+			want: socketPermissions{mode: 0o660, uid: -1, gid: -1},
+		},
+		{
+			name: "numeric owner and group",
+			cfg:  config{BindOwner: "1000", BindGroup: "1001"},
+			want: socketPermissions{uid: 1000, gid: 1001},
+		},
+		{
+			name:    "mode not octal",
+			cfg:     config{BindMode: "0968"},
+			wantErr: true,
+		},
+		{
+			name:    "mode out of range",
+			cfg:     config{BindMode: "1777"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.socketPermissions()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSocketPermissions_Apply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coraza.sock")
+	l, err := listen(context.Background(), "unix", path, socketPermissions{mode: 0o600, uid: -1, gid: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != 0o600 {
+		t.Errorf("expected mode 0600, got %o", got)
+	}
+}
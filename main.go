@@ -5,9 +5,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,7 +16,6 @@ import (
 	"runtime/pprof"
 	"syscall"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 
 	"github.com/corazawaf/coraza-spoa/internal"
@@ -29,10 +28,12 @@ var (
 var (
 	configPath     string
 	validateConfig bool
+	printSchema    bool
 	autoReload     bool
 	cpuProfile     string
 	memProfile     string
 	metricsAddr    string
+	adminAPI       bool
 	showVersion    bool
 	globalLogger   = zerolog.New(os.Stderr).With().Timestamp().Logger()
 )
@@ -40,10 +41,12 @@ var (
 func main() {
 	flag.StringVar(&configPath, "config", "", "configuration file")
 	flag.BoolVar(&validateConfig, "validate", false, "validate configuration file and exit")
+	flag.BoolVar(&printSchema, "print-schema", false, "print the JSON schema of the configuration file and exit")
 	flag.BoolVar(&autoReload, "autoreload", false, "reload configuration file on k8s configmap update")
 	flag.StringVar(&cpuProfile, "cpuprofile", "", "write cpu profile to `file`")
 	flag.StringVar(&memProfile, "memprofile", "", "write memory profile to `file`")
-	flag.StringVar(&metricsAddr, "metrics-addr", "", "ip:port bind for prometheus metrics")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "ip:port bind for prometheus metrics and health probes")
+	flag.BoolVar(&adminAPI, "admin-api", false, "serve the admin API on the metrics address")
 	flag.BoolVar(&showVersion, "version", false, "show version and exit")
 	flag.Parse()
 
@@ -55,6 +58,15 @@ func main() {
 		return
 	}
 
+	if printSchema {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(configSchema()); err != nil {
+			globalLogger.Fatal().Err(err).Msg("Failed printing schema")
+		}
+		return
+	}
+
 	if configPath == "" {
 		globalLogger.Fatal().Msg("Configuration file is not set")
 	}
@@ -82,7 +94,36 @@ func main() {
 	}
 	globalLogger = logger
 
-	apps, err := cfg.newApplications()
+	// Reload requests of the config watcher and the admin API are handled
+	// by the main loop, just like SIGHUP.
+	reloadRequests := make(chan chan reloadResult)
+	requestReload := func(ctx context.Context) (reloadSummary, error) {
+		done := make(chan reloadResult, 1)
+		select {
+		case reloadRequests <- done:
+		case <-ctx.Done():
+			return reloadSummary{}, ctx.Err()
+		}
+		select {
+		case res := <-done:
+			return res.summary, res.err
+		case <-ctx.Done():
+			return reloadSummary{}, ctx.Err()
+		}
+	}
+
+	admin := &adminServer{reload: requestReload}
+	if metricsAddr != "" && !validateConfig {
+		// Start serving before the applications are compiled, so the
+		// health probes can tell a slow start from a dead process.
+		go func() {
+			if err := http.ListenAndServe(metricsAddr, admin.handler(adminAPI)); err != nil {
+				globalLogger.Error().Err(err).Msg("Metrics server failed")
+			}
+		}()
+	}
+
+	apps, err := cfg.newApplications(nil)
 	if err != nil {
 		globalLogger.Fatal().Err(err).Msg("Failed creating applications")
 	}
@@ -95,39 +136,44 @@ func main() {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
-	network, address := cfg.networkAddressFromBind()
-	l, err := (&net.ListenConfig{}).Listen(ctx, network, address)
-	if err != nil {
-		globalLogger.Fatal().Err(err).Msg("Failed opening socket")
-	}
-
 	a := &internal.Agent{
 		Context:            ctx,
 		DefaultApplication: apps[cfg.DefaultApplication],
 		Applications:       apps,
+		Routes:             cfg.routes,
+		OnError:            cfg.onErrorAction,
 		Logger:             globalLogger,
 	}
-	go func() {
-		defer cancelFunc()
+	globalLogger.Info().Msg("Starting coraza-spoa")
+	listeners, err := newListenerSet(ctx, a)
+	if err != nil {
+		globalLogger.Fatal().Err(err).Msg("Failed opening socket")
+	}
+	if err := listeners.update(cfg.Bind, cfg.perm); err != nil {
+		globalLogger.Fatal().Err(err).Msg("Failed opening socket")
+	}
 
-		globalLogger.Info().Msg("Starting coraza-spoa")
-		if err := a.Serve(l); err != nil {
-			globalLogger.Fatal().Err(err).Msg("Listener closed")
-		}
-	}()
+	admin.setReady(a, cfg)
 
-	if metricsAddr != "" {
-		go func() {
-			http.Handle("/metrics", promhttp.Handler())
-			if err := http.ListenAndServe(metricsAddr, nil); err != nil {
-				globalLogger.Error().Err(err).Msg("Metrics server failed")
-			}
-		}()
+	reload := func() reloadResult {
+		newCfg, summary, err := cfg.reloadConfig(a, listeners)
+		if err != nil {
+			globalLogger.Error().Err(err).Msg("Failed to reload configuration, using old configuration")
+			return reloadResult{err: err}
+		}
+		cfg = newCfg
+		admin.config.Store(cfg)
+		return reloadResult{summary: summary}
 	}
 
 	if autoReload {
 		go func() {
-			if err := cfg.watchConfig(a); err != nil {
+			reload := func() error {
+				_, err := requestReload(ctx)
+				return err
+			}
+			watchDirs := func() []string { return admin.config.Load().watchDirs() }
+			if err := watchConfig(reload, watchDirs); err != nil {
 				globalLogger.Fatal().Err(err).Msg("Config watcher failed")
 			}
 		}()
@@ -137,31 +183,36 @@ func main() {
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT)
 outer:
 	for {
-		sig := <-sigCh
-		switch sig {
-		case syscall.SIGTERM:
-			globalLogger.Info().Msg("Received SIGTERM, shutting down...")
-			// this return will run cancel() and close the server
-			break outer
-		case syscall.SIGINT:
-			globalLogger.Info().Msg("Received SIGINT, shutting down...")
-			break outer
-		case syscall.SIGHUP:
-			globalLogger.Info().Msg("Received SIGHUP, reloading configuration...")
-			newCfg, err := cfg.reloadConfig(a)
-			if err != nil {
-				globalLogger.Error().Err(err).Msg("Failed to reload configuration, using old configuration")
-				continue
+		select {
+		case done := <-reloadRequests:
+			done <- reload()
+		case sig := <-sigCh:
+			switch sig {
+			case syscall.SIGTERM:
+				globalLogger.Info().Msg("Received SIGTERM, shutting down...")
+				// this return will run cancel() and close the server
+				break outer
+			case syscall.SIGINT:
+				globalLogger.Info().Msg("Received SIGINT, shutting down...")
+				break outer
+			case syscall.SIGHUP:
+				globalLogger.Info().Msg("Received SIGHUP, reloading configuration...")
+				_ = reload()
 			}
-			cfg = newCfg
 		}
 	}
+	admin.ready.Store(false)
 
-	// Stop accepting new connections before draining background work.
-	cancelFunc()
+	// Stop accepting new connections, give the in-flight messages time to
+	// complete and close all cached transactions, so they are logged.
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.shutdownGracePeriod())
+	if err := a.Shutdown(shutdownCtx); err != nil {
+		globalLogger.Warn().Err(err).Msg("Shutdown grace period exceeded")
+	}
+	shutdownCancel()
 
-	// Drain in-flight detect-only background evaluations before exit.
-	a.DrainDetectOnly()
+	// Close the remaining connections.
+	cancelFunc()
 
 	if memProfile != "" {
 		f, err := os.Create(memProfile)
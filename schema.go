@@ -0,0 +1,130 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/corazawaf/coraza-spoa/internal"
+)
+
+// schemaEnums are the allowed values of string settings by key.
+var schemaEnums = map[string][]string{
+	"log_level":  {"trace", "debug", "info", "warn", "error", "fatal", "panic", "disabled"},
+	"log_format": {"console", "json"},
+	"on_error":   {string(internal.FailActionAllow), string(internal.FailActionDeny)},
+	"truncated_body": {
+		string(internal.TruncatedBodyInspectPartial),
+		string(internal.TruncatedBodyDeny),
+		string(internal.TruncatedBodySkipBody),
+	},
+	"interruption_fields": {
+		string(internal.InterruptionFieldMsg),
+		string(internal.InterruptionFieldSeverity),
+		string(internal.InterruptionFieldTags),
+		string(internal.InterruptionFieldPhase),
+		string(internal.InterruptionFieldMatchedVar),
+		string(internal.InterruptionFieldInboundAnomalyScore),
+		string(internal.InterruptionFieldOutboundAnomalyScore),
+		string(internal.InterruptionFieldParanoiaLevel),
+	},
+	"type": {
+		internal.IDGeneratorUUIDv4,
+		internal.IDGeneratorUUIDv7,
+		internal.IDGeneratorULID,
+		internal.IDGeneratorCounter,
+	},
+}
+
+// configSchema returns a JSON schema of the config file for editors. It is
+// derived from the yaml tags of the config types.
+func configSchema() map[string]any {
+	schema := typeSchema(reflect.TypeFor[config](), "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "coraza-spoa configuration"
+	return schema
+}
+
+func typeSchema(t reflect.Type, key string) map[string]any {
+	switch t {
+	case reflect.TypeFor[bindList]():
+		// a single address or a list of addresses
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		}}
+	case reflect.TypeFor[idGeneratorConfig]():
+		// the type or a mapping to configure the counter generator
+		object := structSchema(t)
+		return map[string]any{"oneOf": []any{typeSchema(reflect.TypeFor[string](), "type"), object}}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if enum, ok := schemaEnums[key]; ok {
+			return interpolated(map[string]any{"type": "string", "enum": enum})
+		}
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return interpolated(map[string]any{"type": "boolean"})
+	case reflect.Int, reflect.Int64:
+		return interpolated(map[string]any{"type": "integer"})
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), key)}
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return map[string]any{}
+	}
+}
+
+func structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	addProperties(t, properties)
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+func addProperties(t reflect.Type, properties map[string]any) {
+	for name, f := range yamlFields(t) {
+		properties[name] = typeSchema(f, name)
+	}
+}
+
+// yamlFields returns the types of the fields of the struct type by their
+// yaml key, including those of inlined structs.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if opts == "inline" {
+			for name, inlined := range yamlFields(f.Type) {
+				fields[name] = inlined
+			}
+			continue
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// interpolated allows a ${...} reference instead of a value of the schema,
+// as references are resolved before the config is decoded.
+func interpolated(schema map[string]any) map[string]any {
+	return map[string]any{"anyOf": []any{
+		schema,
+		map[string]any{"type": "string", "pattern": `\$\{`},
+	}}
+}
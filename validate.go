@@ -0,0 +1,160 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// position is the location of a value in a config file.
+type position struct {
+	file string
+	line int
+}
+
+func (p position) String() string {
+	if p.line == 0 {
+		return p.file
+	}
+	return fmt.Sprintf("%s:%d", p.file, p.line)
+}
+
+// nodePositions locates the keys of a mapping node.
+type nodePositions struct {
+	position
+	keys map[string]int
+}
+
+// key returns the position of the key, or of the mapping if it is not set.
+func (p nodePositions) key(name string) position {
+	if line, ok := p.keys[name]; ok {
+		return position{file: p.file, line: line}
+	}
+	return p.position
+}
+
+func mappingPositions(file string, node *yaml.Node) nodePositions {
+	p := nodePositions{
+		position: position{file: file, line: node.Line},
+		keys:     make(map[string]int),
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		p.keys[node.Content[i].Value] = node.Content[i].Line
+	}
+	return p
+}
+
+// configPositions locates the top-level keys of the main config file and
+// the applications of all files.
+type configPositions struct {
+	root         nodePositions
+	applications []nodePositions
+}
+
+// readPositions reads the positions of a config file. The applications are
+// appended to those read before.
+func (p *configPositions) readPositions(file string, root *yaml.Node) {
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return
+	}
+	mapping := root.Content[0]
+	if p.root.file == "" {
+		p.root = mappingPositions(file, mapping)
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != "applications" {
+			continue
+		}
+		for _, app := range mapping.Content[i+1].Content {
+			p.applications = append(p.applications, mappingPositions(file, app))
+		}
+	}
+}
+
+// application returns the positions of the i-th application.
+func (p configPositions) application(i int) nodePositions {
+	if i < len(p.applications) {
+		return p.applications[i]
+	}
+	return nodePositions{position: position{file: configPath}}
+}
+
+// checkSemantics reports mistakes in the config which decode fine, with
+// their position. Settings which are likely unintended but valid are
+// logged as warnings.
+func (c config) checkSemantics() error {
+	var errs []error
+	if key, err := c.Log.check(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %v", c.positions.root.key(key), err))
+	}
+
+	names := make(map[string]position, len(c.Applications))
+	for i, a := range c.Applications {
+		pos := c.positions.application(i)
+		if prev, ok := names[a.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s: application %q is already defined at %s", pos.key("name"), a.Name, prev))
+		} else {
+			names[a.Name] = pos.key("name")
+		}
+
+		if key, err := a.Log.check(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: application %q: %v", pos.key(key), a.Name, err))
+		}
+		if a.ResponseCheck && a.TransactionTTLMS <= 0 {
+			errs = append(errs, fmt.Errorf("%s: application %q: response_check requires a transaction_ttl_ms greater than 0, otherwise the transactions expire before the response", pos.key("transaction_ttl_ms"), a.Name))
+		}
+
+		if ruleEngineOff(a.settings.directives, a.settings.directivesFiles) {
+			globalLogger.Warn().Str("app", a.Name).Str("position", pos.String()).
+				Msg("SecRuleEngine is Off, requests are not inspected")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// check validates the log format and level, and returns the key of the
+// invalid setting.
+func (lc logConfig) check() (string, error) {
+	switch lc.Format {
+	case "console", "json":
+	default:
+		return "log_format", fmt.Errorf("unknown log_format %q, expected console or json", lc.Format)
+	}
+	if _, err := zerolog.ParseLevel(lc.Level); err != nil {
+		return "log_level", fmt.Errorf("unknown log_level %q", lc.Level)
+	}
+	return "", nil
+}
+
+// ruleEngineOff reports if the last SecRuleEngine directive of the inline
+// directives and the directives files turns the engine off. Files included
+// with Include are not followed.
+func ruleEngineOff(directives string, files []string) bool {
+	engine := lastRuleEngine(directives, "")
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		engine = lastRuleEngine(string(data), engine)
+	}
+	return strings.EqualFold(engine, "Off")
+}
+
+func lastRuleEngine(directives string, engine string) string {
+	for _, line := range strings.Split(directives, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[0], "SecRuleEngine") {
+			engine = strings.Trim(fields[1], `"'`)
+		}
+	}
+	return engine
+}